@@ -1,9 +1,14 @@
 package progimg
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"image"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,6 +18,9 @@ import (
 // 1. base64 image upload
 // 2. image url
 // 3. multipart upload
+// "orient=true" turns the image upright as per its exif orientation before storing
+// metadata is removed before storing as per the upload strip policy
+// images encoded again run on the transform pool and fail with 503 when it is busy
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	r.ParseMultipartForm(32 << 20)
@@ -26,18 +34,36 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	img, err := h(r)
+	var orient bool
+	if err == nil {
+		orient, err = parseOrient(r)
+	}
+
+	if err == nil && (orient || uploadStrip != stripNone) {
+		err = transformPool.do(func() error {
+			return prepareUpload(img, orient)
+		})
+	}
+
 	if err != nil {
-		writeJSONResponse(w, http.StatusBadRequest, map[string]string{
+		status := http.StatusBadRequest
+		if err == errQueueFull {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+		}
+
+		writeJSONResponse(w, status, map[string]string{
 			"error": err.Error(),
 		})
 		return
 	}
 
-	err = saveImage(getPath(img.ID), img)
+	err = saveImage(img, imgType)
 	if err != nil {
 		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{
 			"error": err.Error(),
 		})
+		return
 	}
 
 	writeJSONResponse(w, http.StatusCreated, map[string]string{
@@ -45,8 +71,38 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// parseOrient checks if the upload asks through "orient" to bake the exif orientation into the image
+func parseOrient(r *http.Request) (bool, error) {
+	v := r.FormValue("orient")
+	if v == "" {
+		return false, nil
+	}
+
+	orient, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid orient: %s", v)
+	}
+
+	return orient, nil
+}
+
+// prepareUpload orients the uploaded image when asked and strips its metadata as per the upload strip policy
+func prepareUpload(img *Image, orient bool) error {
+	if orient {
+		err := orientOriginal(img)
+		if err != nil {
+			return err
+		}
+	}
+
+	return stripMetadata(img, uploadStrip)
+}
+
 // handleDownload posts the matching image back
-// It also support format conversion received through "format" query
+// It also support transformations received either as a pipeline in the url path
+// eg: /images/{id}/resize:400x300/format:png
+// or through "format", "w", "h", "fit", "crop" and "gravity" queries
+// format auto picks the output format from the accept header
 func handleDownload(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	vars := mux.Vars(r)
@@ -57,24 +113,50 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	img, err := getImage(getPath(id))
+
+	r.ParseForm()
+	var p *pipeline
+	var err error
+	if ops := vars["ops"]; ops != "" {
+		p, err = parsePathPipeline(ops)
+	} else {
+		p, err = parseQueryPipeline(r.Form)
+	}
+
 	if err != nil {
-		writeJSONResponse(w, http.StatusNotFound, map[string]string{
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{
 			"error": err.Error(),
 		})
 		return
 	}
 
-	r.ParseForm()
-	ct := r.Form.Get("format")
-	if ct != "" && ct != img.Format {
-		err := transformImage(ct, img)
-		if err != nil {
-			writeJSONResponse(w, http.StatusBadRequest, map[string]string{
-				"error": err.Error(),
-			})
-			return
+	if p.format == autoFormat {
+		w.Header().Set("Vary", "Accept")
+		p.format, err = negotiateFormat(r.Header.Get("Accept"), func() (string, error) {
+			return storedFormat(id)
+		})
+	}
+
+	var img *Image
+	if err == nil {
+		img, err = getDerivative(id, p)
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(transformError); ok {
+			status = http.StatusBadRequest
+		} else if err == ErrImageNotFound {
+			status = http.StatusNotFound
+		} else if err == errQueueFull {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
 		}
+
+		writeJSONResponse(w, status, map[string]string{
+			"error": err.Error(),
+		})
+		return
 	}
 
 	w.Header().Add("Content-type", fmt.Sprintf("image/%s", img.Format))
@@ -82,6 +164,206 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	w.Write(img.Data)
 }
 
+// imageInfo describes a stored image
+type imageInfo struct {
+	ID         string     `json:"id"`
+	Format     string     `json:"format"`
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	Size       int64      `json:"size"`
+	ColorModel string     `json:"color_model"`
+	Hash       string     `json:"hash"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	Source     string     `json:"source,omitempty"`
+}
+
+// handleInfo posts the description of the matching image
+// upload time and source are only known for the images present in the index
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	id := vars["id"]
+	img, err := getImage(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrImageNotFound {
+			status = http.StatusNotFound
+		}
+
+		writeJSONResponse(w, status, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	info := imageInfo{
+		ID:         img.ID,
+		Format:     img.Format,
+		Size:       int64(len(img.Data)),
+		ColorModel: "unknown",
+		Hash:       sha256Hex(img.Data),
+	}
+
+	c, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err == nil {
+		info.Width, info.Height = c.Width, c.Height
+		info.ColorModel = colorModelName(c.ColorModel)
+
+		// orientations 5 to 8 turn the image sideways
+		if exifOrientation(img) >= 5 {
+			info.Width, info.Height = c.Height, c.Width
+		}
+	}
+
+	if imageIndex != nil {
+		m, err := imageIndex.Get(id)
+		if err == nil {
+			info.CreatedAt = &m.CreatedAt
+			info.Source = m.Source
+		}
+	}
+
+	writeJSONResponse(w, http.StatusOK, info)
+}
+
+// handleMetadata posts the exif and xmp metadata embedded in the matching image
+func handleMetadata(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	img, err := getImage(vars["id"])
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrImageNotFound {
+			status = http.StatusNotFound
+		}
+
+		writeJSONResponse(w, status, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, getMetadata(img))
+}
+
+// handleDelete removes the matching image
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	id := vars["id"]
+	err := deleteImage(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrImageNotFound {
+			status = http.StatusNotFound
+		}
+
+		writeJSONResponse(w, status, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultListLimit is the number of images listed when no limit is given
+const defaultListLimit = 50
+
+// listResponse is the response of the image listing
+type listResponse struct {
+	Images     []*ImageMeta `json:"images"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// parseListQuery builds the index query from the listing request
+func parseListQuery(r *http.Request) (q ListQuery, err error) {
+	r.ParseForm()
+	q.Format = strings.TrimPrefix(r.Form.Get("format"), "image/")
+	q.Sort = r.Form.Get("sort")
+	switch q.Sort {
+	case "":
+		q.Sort = "created"
+	case "created", "size":
+	default:
+		return q, fmt.Errorf("unknown sort field: %s", q.Sort)
+	}
+
+	q.Cursor = r.Form.Get("cursor")
+	if q.Cursor != "" {
+		_, err = decodeCursor(q.Sort, q.Cursor)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	q.Limit = defaultListLimit
+	if l := r.Form.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit < 1 || q.Limit > maxListLimit {
+			return q, fmt.Errorf("invalid limit: %s", l)
+		}
+	}
+
+	switch o := r.Form.Get("order"); o {
+	case "", "desc":
+		q.Desc = true
+	case "asc":
+	default:
+		return q, fmt.Errorf("invalid order: %s", o)
+	}
+
+	for k, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		v := r.Form.Get(k)
+		if v == "" {
+			continue
+		}
+
+		*t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s time: %s", k, v)
+		}
+	}
+
+	return q, nil
+}
+
+// handleList lists a page of the uploaded images from the index
+func handleList(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if imageIndex == nil {
+		writeJSONResponse(w, http.StatusNotImplemented, map[string]string{
+			"error": "image index is not configured",
+		})
+		return
+	}
+
+	q, err := parseListQuery(r)
+	if err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ms, next, err := imageIndex.Query(q)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if ms == nil {
+		ms = []*ImageMeta{}
+	}
+
+	writeJSONResponse(w, http.StatusOK, listResponse{
+		Images:     ms,
+		NextCursor: next,
+	})
+}
+
 // handle404 handles url requests not registered with router
 func handle404(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -3,7 +3,10 @@ package progimg
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"image"
+	"image/gif"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,17 +16,32 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
 
 func setup() *httptest.Server {
+	dir, err := ioutil.TempDir("", "prog-image-index")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	imageIndex, err = OpenIndex(filepath.Join(dir, "index.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	r := getRouter()
 	return httptest.NewServer(r)
 }
 
 func cleanup(s *httptest.Server) {
 	s.Close()
+	path := imageIndex.db.Path()
+	imageIndex.Close()
+	imageIndex = nil
+	os.RemoveAll(filepath.Dir(path))
 }
 
 func getTestBase64(path string) string {
@@ -74,7 +92,16 @@ func postTestImage(t *testing.T, s *httptest.Server) (id string) {
 
 func Test_uploadImage_base64(t *testing.T) {
 	s := setup()
-	postTestImage(t, s)
+	id := postTestImage(t, s)
+	m, err := imageIndex.Get(id)
+	if err != nil {
+		t.Fatalf("unexpected error: index: %v", err)
+	}
+
+	if m.Source != "base64" || m.Format != "png" || m.Width == 0 || m.Height == 0 {
+		t.Fatalf("unexpected error: index entry: %+v", m)
+	}
+
 	cleanup(s)
 }
 
@@ -284,3 +311,754 @@ func Test_downloadImage_covert_unknown(t *testing.T) {
 		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
 	}
 }
+
+func Test_deleteImage(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	req, _ := http.NewRequest("DELETE", s.URL+"/images/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: delete fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	if _, err := imageIndex.Get(id); err != ErrImageNotFound {
+		t.Fatalf("expected index entry to be removed but got %v", err)
+	}
+
+	resp, err = http.Get(s.URL + "/images/" + id)
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: delete fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if ct != "application/json" {
+		t.Fatalf("unexpected error: content-type: %s", ct)
+	}
+
+	cleanup(s)
+}
+
+func Test_listImages(t *testing.T) {
+	s := setup()
+	ids := []string{postTestImage(t, s), postTestImage(t, s), postTestImage(t, s)}
+	var listed []string
+	u := s.URL + "/images?order=asc&limit=2&format=png"
+	for u != "" {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+		}
+
+		var res listResponse
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: json decode: %v", err)
+		}
+
+		for _, m := range res.Images {
+			if m.Size == 0 || m.CreatedAt.IsZero() {
+				t.Fatalf("unexpected error: list entry: %+v", m)
+			}
+
+			listed = append(listed, m.ID)
+		}
+
+		u = ""
+		if res.NextCursor != "" {
+			u = s.URL + "/images?order=asc&limit=2&format=png&cursor=" + res.NextCursor
+		}
+	}
+
+	if !reflect.DeepEqual(ids, listed) {
+		t.Fatalf("expected %v but got %v", ids, listed)
+	}
+
+	for _, q := range []string{"limit=0", "order=up", "sort=name", "from=yesterday", "cursor=abc"} {
+		resp, err := http.Get(s.URL + "/images?" + q)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("unexpected error: %s: status code: %d", q, resp.StatusCode)
+		}
+	}
+
+	cleanup(s)
+}
+
+func Test_imageInfo(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	resp, err := http.Get(s.URL + "/images/" + id + "/info")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	var info imageInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: json decode: %v", err)
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.png"))
+	if info.ID != id || info.Format != "png" || info.Width != 600 || info.Height != 600 ||
+		info.Size != int64(len(data)) || info.Hash != sha256Hex(data) ||
+		info.ColorModel == "unknown" || info.Source != "base64" || info.CreatedAt == nil {
+		t.Fatalf("unexpected error: info: %+v", info)
+	}
+
+	// orientation 6 turns the 40x20 image sideways
+	jpg, err := encodeImage(testImage(40, 20), "jpeg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	form := url.Values{}
+	form.Add("type", "base64")
+	form.Add("image", base64.StdEncoding.EncodeToString(withJPEGEXIF(jpg, testEXIF(binary.LittleEndian, 6))))
+	resp, err = http.PostForm(s.URL+"/images", form)
+	if err != nil {
+		t.Fatalf("unexpected error: post fail: %v", err)
+	}
+
+	var res struct {
+		ID string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected error: upload: %d %v", resp.StatusCode, err)
+	}
+
+	resp, err = http.Get(s.URL + "/images/" + res.ID + "/info")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	info = imageInfo{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil || info.Width != 20 || info.Height != 40 {
+		t.Fatalf("unexpected error: oriented info: %+v %v", info, err)
+	}
+
+	resp, err = http.Get(s.URL + "/images/unknown/info")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_resize(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	resp, err := http.Get(s.URL + "/images/" + id + "?w=120&h=80&fit=cover&format=jpeg")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	c, format, err := image.DecodeConfig(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if format != "jpeg" || c.Width != 120 || c.Height != 80 {
+		t.Fatalf("unexpected error: resized image: %s %dx%d", format, c.Width, c.Height)
+	}
+
+	resp, err = http.Get(s.URL + "/images/" + id + "?crop=300,200&gravity=northeast&w=150&format=png")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	c, format, err = image.DecodeConfig(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if format != "png" || c.Width != 150 || c.Height != 100 {
+		t.Fatalf("unexpected error: cropped image: %s %dx%d", format, c.Width, c.Height)
+	}
+
+	resp, err = http.Get(s.URL + "/images/" + id + "?w=-1")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_pipeline(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	resp, err := http.Get(s.URL + "/images/" + id + "/crop:300,200:northeast/resize:150x/format:jpeg")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	c, format, err := image.DecodeConfig(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if format != "jpeg" || c.Width != 150 || c.Height != 100 {
+		t.Fatalf("unexpected error: transformed image: %s %dx%d", format, c.Width, c.Height)
+	}
+
+	for _, ops := range []string{"rotate:abc", "resize:10", "format:pdf"} {
+		resp, err = http.Get(s.URL + "/images/" + id + "/" + ops)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("unexpected error: %s: status code: %d", ops, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.Get(s.URL + "/images/unknown/resize:10x")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_cached(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	get := func() int {
+		resp, err := http.Get(s.URL + "/images/" + id + "/resize:100x/format:jpeg")
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if c := get(); c != http.StatusOK {
+		t.Fatalf("unexpected error: status code: %d", c)
+	}
+
+	// the derivative is served from cache even after the original is gone
+	imageStore.Delete(id)
+	if c := get(); c != http.StatusOK {
+		t.Fatalf("expected cached derivative but got status code: %d", c)
+	}
+
+	deleteImage(id)
+	if c := get(); c != http.StatusNotFound {
+		t.Fatalf("expected invalidated derivative but got status code: %d", c)
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_busy(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	pool := transformPool
+	transformPool = newWorkPool(1, 0)
+	defer func() { transformPool = pool }()
+
+	// hold the only worker so the transformation can't be queued
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go transformPool.do(func() error {
+		close(running)
+		<-release
+		return nil
+	})
+	<-running
+
+	resp, err := http.Get(s.URL + "/images/" + id + "/resize:100x/format:jpeg")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+
+	close(release)
+	resp, err = http.Get(s.URL + "/debug/vars")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected metrics to be hidden from the public router but got %d", resp.StatusCode)
+	}
+
+	admin := httptest.NewServer(getAdminRouter())
+	defer admin.Close()
+	resp, err = http.Get(admin.URL + "/debug/vars")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	defer resp.Body.Close()
+	var vars struct {
+		Pool map[string]int64 `json:"transform_pool"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if vars.Pool["rejected"] != 1 || vars.Pool["workers"] != 1 {
+		t.Fatalf("unexpected pool stats: %v", vars.Pool)
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_gif(t *testing.T) {
+	s := setup()
+	form := url.Values{}
+	form.Add("type", "base64")
+	form.Add("image", base64.StdEncoding.EncodeToString(testGIF(t)))
+	resp, err := http.PostForm(s.URL+"/images", form)
+	if err != nil {
+		t.Fatalf("unexpected error: post fail: %v", err)
+	}
+
+	var res struct {
+		ID string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected error: upload: %d %v", resp.StatusCode, err)
+	}
+
+	resp, err = http.Get(s.URL + "/images/" + res.ID + "?w=20")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	g, err := gif.DecodeAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if len(g.Image) != 3 || g.Config.Width != 20 || resp.Header.Get("Content-Type") != "image/gif" {
+		t.Fatalf("unexpected animation: %d frames of width %d", len(g.Image), g.Config.Width)
+	}
+
+	// negotiation keeps the frames of the gif
+	req, _ := http.NewRequest("GET", s.URL+"/images/"+res.ID+"?format=auto", nil)
+	req.Header.Set("Accept", "image/webp,image/*")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	g, err = gif.DecodeAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(g.Image) != 3 || resp.Header.Get("Content-Type") != "image/gif" {
+		t.Fatalf("expected an animated gif but got %s: %v", resp.Header.Get("Content-Type"), err)
+	}
+
+	resp, err = http.Get(s.URL + "/images/" + res.ID + "/frame:3/format:png")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	c, format, err := image.DecodeConfig(resp.Body)
+	resp.Body.Close()
+	if err != nil || format != "png" || c.Width != 40 {
+		t.Fatalf("unexpected frame: %s %v %v", format, c, err)
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_auto(t *testing.T) {
+	s := setup()
+	id := postTestImage(t, s)
+	tests := []struct {
+		path   string
+		accept string
+		ct     string
+	}{
+		{
+			path:   "?format=auto",
+			accept: "image/avif,image/webp,image/*,*/*;q=0.8",
+			ct:     "image/webp",
+		},
+
+		{
+			path:   "/resize:100x/format:auto",
+			accept: "image/webp",
+			ct:     "image/webp",
+		},
+
+		{
+			path:   "?format=auto",
+			accept: "image/png,image/*;q=0.8",
+			ct:     "image/png",
+		},
+
+		{
+			path: "?format=auto",
+			ct:   "image/png",
+		},
+	}
+
+	for _, c := range tests {
+		req, _ := http.NewRequest("GET", s.URL+"/images/"+id+c.path, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		_, format, err := image.DecodeConfig(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.Header.Get("Content-Type") != c.ct || "image/"+format != c.ct {
+			t.Fatalf("expected %s but got %s: %v", c.ct, resp.Header.Get("Content-Type"), err)
+		}
+
+		if resp.Header.Get("Vary") != "Accept" {
+			t.Fatalf("expected Vary header for %s", c.path)
+		}
+	}
+
+	cleanup(s)
+}
+
+func Test_downloadImage_auto_jpeg(t *testing.T) {
+	s := setup()
+	jpg, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.jpeg"))
+	form := url.Values{}
+	form.Add("type", "base64")
+	form.Add("image", base64.StdEncoding.EncodeToString(jpg))
+	resp, err := http.PostForm(s.URL+"/images", form)
+	if err != nil {
+		t.Fatalf("unexpected error: post fail: %v", err)
+	}
+
+	var res struct {
+		ID string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected error: upload: %d %v", resp.StatusCode, err)
+	}
+
+	// auto never serves a jpeg in a larger format to the clients accepting jpeg
+	for _, accept := range []string{
+		"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8",
+		"image/avif,image/webp,*/*",
+		"image/webp,image/png,image/svg+xml,image/*;q=0.8,video/*;q=0.8,*/*;q=0.5",
+		"image/webp",
+		"*/*",
+	} {
+		req, _ := http.NewRequest("GET", s.URL+"/images/"+res.ID+"?format=auto", nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected error: %d %v", resp.StatusCode, err)
+		}
+
+		if len(data) > len(jpg) {
+			t.Fatalf("expected at most %d bytes but got %d of %s for %s",
+				len(jpg), len(data), resp.Header.Get("Content-Type"), accept)
+		}
+	}
+
+	cleanup(s)
+}
+
+func Test_uploadImage_busy(t *testing.T) {
+	s := setup()
+	pool, strip := transformPool, uploadStrip
+	transformPool = newWorkPool(1, 0)
+	defer func() { transformPool, uploadStrip = pool, strip }()
+
+	// hold the only worker so the images encoded again can't be queued
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go transformPool.do(func() error {
+		close(running)
+		<-release
+		return nil
+	})
+	<-running
+	defer close(release)
+
+	tests := []struct {
+		orient string
+		strip  string
+		status int
+	}{
+		{
+			strip:  stripNone,
+			status: http.StatusCreated,
+		},
+
+		{
+			orient: "true",
+			strip:  stripNone,
+			status: http.StatusServiceUnavailable,
+		},
+
+		{
+			strip:  stripAll,
+			status: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, c := range tests {
+		uploadStrip = c.strip
+		form := url.Values{}
+		form.Add("type", "base64")
+		form.Add("image", getTestBase64("./testdata/testimg.jpeg"))
+		form.Add("orient", c.orient)
+		resp, err := http.PostForm(s.URL+"/images", form)
+		if err != nil {
+			t.Fatalf("unexpected error: post fail: %v", err)
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("expected %d but got %d for orient=%s strip=%s", c.status, resp.StatusCode, c.orient, c.strip)
+		}
+
+		if c.status == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("expected Retry-After header")
+		}
+	}
+
+	cleanup(s)
+}
+
+func Test_uploadImage_orient(t *testing.T) {
+	s := setup()
+	jpg, err := encodeImage(testImage(40, 20), "jpeg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	data := withJPEGEXIF(jpg, testEXIF(binary.LittleEndian, 6))
+	tests := []struct {
+		orient string
+		path   string
+		size   image.Point
+		err    bool
+	}{
+		{
+			path: "",
+			size: image.Pt(40, 20),
+		},
+
+		{
+			path: "?format=png",
+			size: image.Pt(20, 40),
+		},
+
+		{
+			orient: "true",
+			size:   image.Pt(20, 40),
+		},
+
+		{
+			orient: "sideways",
+			err:    true,
+		},
+	}
+
+	for _, c := range tests {
+		form := url.Values{}
+		form.Add("type", "base64")
+		form.Add("image", base64.StdEncoding.EncodeToString(data))
+		form.Add("orient", c.orient)
+		resp, err := http.PostForm(s.URL+"/images", form)
+		if err != nil {
+			t.Fatalf("unexpected error: post fail: %v", err)
+		}
+
+		var res struct {
+			ID string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if c.err {
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected %d but got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+
+			continue
+		}
+
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("unexpected error: upload: %d %v", resp.StatusCode, err)
+		}
+
+		resp, err = http.Get(s.URL + "/images/" + res.ID + c.path)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		conf, _, err := image.DecodeConfig(resp.Body)
+		resp.Body.Close()
+		if err != nil || image.Pt(conf.Width, conf.Height) != c.size {
+			t.Fatalf("expected %v but got %dx%d: %v", c.size, conf.Width, conf.Height, err)
+		}
+	}
+
+	cleanup(s)
+}
+
+func Test_imageMetadata(t *testing.T) {
+	s := setup()
+	jpg, err := encodeImage(testImage(40, 20), "jpeg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	data := base64.StdEncoding.EncodeToString(withJPEGEXIF(jpg, testCameraEXIF(binary.BigEndian)))
+	upload := func() string {
+		form := url.Values{}
+		form.Add("type", "base64")
+		form.Add("image", data)
+		resp, err := http.PostForm(s.URL+"/images", form)
+		if err != nil {
+			t.Fatalf("unexpected error: post fail: %v", err)
+		}
+
+		defer resp.Body.Close()
+		var res struct {
+			ID string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("unexpected error: upload: %d %v", resp.StatusCode, err)
+		}
+
+		return res.ID
+	}
+
+	metadata := func(path string) *imageMetadata {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: get fail: %v", err)
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected error: status code: %d", resp.StatusCode)
+		}
+
+		var m imageMetadata
+		err = json.NewDecoder(resp.Body).Decode(&m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return &m
+	}
+
+	id := upload()
+	m := metadata("/images/" + id + "/metadata")
+	if m.ID != id || m.EXIF == nil || m.EXIF.Make != "Canon" || m.EXIF.GPS == nil {
+		t.Fatalf("unexpected metadata: %+v", m.EXIF)
+	}
+
+	resp, err := http.Get(s.URL + "/images/" + id + "?strip=true")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	stripped, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || jpegEXIF(stripped) != nil || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("expected the metadata to be stripped: %v", err)
+	}
+
+	uploadStrip = stripPrivate
+	defer func() { uploadStrip = stripNone }()
+	m = metadata("/images/" + upload() + "/metadata")
+	if m.EXIF == nil || m.EXIF.Make != "Canon" || m.EXIF.GPS != nil {
+		t.Fatalf("expected the location to be stripped: %+v", m.EXIF)
+	}
+
+	resp, err = http.Get(s.URL + "/images/unknown-metadata/metadata")
+	if err != nil {
+		t.Fatalf("unexpected error: get fail: %v", err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	cleanup(s)
+}
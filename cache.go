@@ -0,0 +1,253 @@
+package progimg
+
+import (
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultCacheSize is the size of the in-memory derivative cache when no cache is configured
+const defaultCacheSize = 64 << 20
+
+// derivatives caches the transformed images, nil disables caching
+var derivatives *Cache
+
+// cacheEntry is a derivative held in the in-memory cache
+type cacheEntry struct {
+	id  string
+	key string
+	img *Image
+}
+
+// Cache holds the transformed images keyed by image id and the canonical pipeline
+// Derivatives are kept in a size bounded in-memory LRU and optionally on disk
+type Cache struct {
+	maxBytes int64  // maxBytes: size limit of the in-memory cache, 0 disables it
+	dir      string // dir: directory of the disk cache, empty disables it
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	items   map[string]map[string]*list.Element // id -> key -> lru element
+	flights map[string]*cacheFlight             // id -> derivatives being generated
+}
+
+// cacheFlight tracks the derivatives of an image being generated
+type cacheFlight struct {
+	gen uint64 // gen: bumped when the image is invalidated
+	n   int    // n: number of reservations
+}
+
+// NewCache returns a cache holding upto maxBytes of derivatives in memory
+// and all derivatives under dir when dir is not empty
+func NewCache(maxBytes int64, dir string) (*Cache, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cache dir %s: %v", dir, err)
+		}
+	}
+
+	return &Cache{
+		maxBytes: maxBytes,
+		dir:      dir,
+		lru:      list.New(),
+		items:    make(map[string]map[string]*list.Element),
+		flights:  make(map[string]*cacheFlight),
+	}, nil
+}
+
+// diskPath returns the path of the derivative in the disk cache
+func (c *Cache) diskPath(id, key string) string {
+	return filepath.Join(c.dir, id, sha256Hex([]byte(key)))
+}
+
+// Get returns the derivative of the image with given id for key
+func (c *Cache) Get(id, key string) (*Image, bool) {
+	if !validID(id) {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	if e, ok := c.items[id][key]; ok {
+		c.lru.MoveToFront(e)
+		img := e.Value.(*cacheEntry).img
+		c.mu.Unlock()
+		return img, true
+	}
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return nil, false
+	}
+
+	// the file read can race with an invalidation
+	gen, release := c.Reserve(id)
+	defer release()
+	f, err := os.Open(c.diskPath(id, key))
+	if err != nil {
+		return nil, false
+	}
+
+	defer f.Close()
+	var img Image
+	err = gob.NewDecoder(f).Decode(&img)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flights[id].gen != gen {
+		return nil, false
+	}
+
+	c.putMemory(id, key, &img)
+	return &img, true
+}
+
+// Reserve marks a derivative of the image with given id as being generated
+// the returned generation is passed to Put which drops the derivative when the
+// image is invalidated in the meantime, release must be called once done
+func (c *Cache) Reserve(id string) (gen uint64, release func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.flights[id]
+	if f == nil {
+		f = &cacheFlight{}
+		c.flights[id] = f
+	}
+
+	f.n++
+	return f.gen, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		f.n--
+		if f.n == 0 {
+			delete(c.flights, id)
+		}
+	}
+}
+
+// Put adds the derivative of the image with given id for key
+// the derivative is dropped unless gen is the generation reserved for the image
+// errors writing to disk are ignored since the derivative can always be generated again
+func (c *Cache) Put(id, key string, gen uint64, img *Image) {
+	if !validID(id) {
+		return
+	}
+
+	// the file is written before checking the generation, so an invalidation
+	// either removes it after the check or is seen by the check
+	var path string
+	if c.dir != "" {
+		path = c.putDisk(id, key, img)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.flights[id]; f == nil || f.gen != gen {
+		if path != "" {
+			os.Remove(path)
+		}
+
+		return
+	}
+
+	c.putMemory(id, key, img)
+}
+
+// putDisk writes the derivative to the disk cache and returns its path, empty when it fails
+func (c *Cache) putDisk(id, key string, img *Image) string {
+	path := c.diskPath(id, key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return ""
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return ""
+	}
+
+	err = gob.NewEncoder(f).Encode(img)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return ""
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+		return ""
+	}
+
+	return path
+}
+
+// putMemory adds the derivative to the in-memory cache evicting the least recently used ones
+// c.mu must be held
+func (c *Cache) putMemory(id, key string, img *Image) {
+	size := int64(len(img.Data))
+	if size > c.maxBytes {
+		return
+	}
+
+	if e, ok := c.items[id][key]; ok {
+		c.remove(e)
+	}
+
+	if c.items[id] == nil {
+		c.items[id] = make(map[string]*list.Element)
+	}
+
+	c.items[id][key] = c.lru.PushFront(&cacheEntry{id: id, key: key, img: img})
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops the element from the in-memory cache
+func (c *Cache) remove(e *list.Element) {
+	ce := c.lru.Remove(e).(*cacheEntry)
+	c.size -= int64(len(ce.img.Data))
+	delete(c.items[ce.id], ce.key)
+	if len(c.items[ce.id]) == 0 {
+		delete(c.items, ce.id)
+	}
+}
+
+// Invalidate removes all the derivatives of the image with given id
+// derivatives of the image being generated are not cached
+func (c *Cache) Invalidate(id string) error {
+	if !validID(id) {
+		return nil
+	}
+
+	c.mu.Lock()
+	for _, e := range c.items[id] {
+		c.remove(e)
+	}
+
+	if f := c.flights[id]; f != nil {
+		f.gen++
+	}
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(filepath.Join(c.dir, id))
+	if err != nil {
+		return fmt.Errorf("failed to remove cached derivatives of %s: %v", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package progimg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// cachePut adds the derivative to the cache under a reservation
+func cachePut(c *Cache, id, key string, img *Image) {
+	gen, release := c.Reserve(id)
+	defer release()
+	c.Put(id, key, gen, img)
+}
+
+func Test_Cache_memory(t *testing.T) {
+	c, _ := NewCache(10, "")
+	cachePut(c, "1", "a", &Image{ID: "1", Data: []byte{1, 2, 3, 4}})
+	cachePut(c, "1", "b", &Image{ID: "1", Data: []byte{1, 2, 3, 4}})
+	cachePut(c, "2", "a", &Image{ID: "2", Data: []byte{1, 2}})
+	if _, ok := c.Get("1", "a"); !ok {
+		t.Fatal("expected 1/a to be cached")
+	}
+
+	// 1/b is the least recently used
+	cachePut(c, "3", "a", &Image{ID: "3", Data: []byte{1, 2, 3}})
+	if _, ok := c.Get("1", "b"); ok {
+		t.Fatal("expected 1/b to be evicted")
+	}
+
+	if c.size != 9 {
+		t.Fatalf("expected cache size 9 but got %d", c.size)
+	}
+
+	// larger than the cache
+	cachePut(c, "4", "a", &Image{ID: "4", Data: make([]byte, 11)})
+	if _, ok := c.Get("4", "a"); ok {
+		t.Fatal("expected 4/a to be skipped")
+	}
+
+	c.Invalidate("1")
+	if _, ok := c.Get("1", "a"); ok {
+		t.Fatal("expected 1/a to be invalidated")
+	}
+
+	if _, ok := c.Get("2", "a"); !ok {
+		t.Fatal("expected 2/a to be cached")
+	}
+
+	if c.size != 5 || len(c.items) != 2 {
+		t.Fatalf("unexpected cache state: size %d, items %d", c.size, len(c.items))
+	}
+}
+
+func Test_Cache_disk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prog-image-cache")
+	if err != nil {
+		t.Fatalf("unexpected error: temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(0, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: new cache: %v", err)
+	}
+
+	img := &Image{ID: "1", Format: "jpeg", Data: []byte{1, 2, 3}}
+	cachePut(c, "1", "resize:10x:inside:center", img)
+	cachePut(c, "..", "a", img)
+
+	// a new cache over the same dir sees the derivatives
+	c, _ = NewCache(10, dir)
+	cimg, ok := c.Get("1", "resize:10x:inside:center")
+	if !ok || !reflect.DeepEqual(img, cimg) {
+		t.Fatalf("expected cached image but got %v", cimg)
+	}
+
+	if _, ok := c.Get("..", "a"); ok {
+		t.Fatal("expected invalid id to be skipped")
+	}
+
+	err = c.Invalidate("1")
+	if err != nil {
+		t.Fatalf("unexpected error: invalidate: %v", err)
+	}
+
+	if _, ok := c.Get("1", "resize:10x:inside:center"); ok {
+		t.Fatal("expected derivative to be invalidated")
+	}
+
+	fis, _ := ioutil.ReadDir(dir)
+	if len(fis) != 0 {
+		t.Fatalf("expected empty cache dir but found %d entries", len(fis))
+	}
+}
+
+func Test_Cache_invalidate_reserved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prog-image-cache")
+	if err != nil {
+		t.Fatalf("unexpected error: temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, _ := NewCache(10, dir)
+	img := &Image{ID: "1", Format: "jpeg", Data: []byte{1, 2, 3}}
+
+	// not reserved
+	c.Put("1", "a", 0, img)
+	if _, ok := c.Get("1", "a"); ok {
+		t.Fatal("expected derivative without a reservation to be dropped")
+	}
+
+	// invalidated while being generated
+	gen, release := c.Reserve("1")
+	c.Invalidate("1")
+	c.Put("1", "a", gen, img)
+	release()
+	if _, ok := c.Get("1", "a"); ok {
+		t.Fatal("expected derivative of the invalidated image to be dropped")
+	}
+
+	fis, _ := ioutil.ReadDir(filepath.Join(dir, "1"))
+	if len(fis) != 0 {
+		t.Fatalf("expected no cached derivatives on disk but found %d", len(fis))
+	}
+
+	// a new reservation after the invalidation is cached
+	gen, release = c.Reserve("1")
+	c.Put("1", "a", gen, img)
+	release()
+	if _, ok := c.Get("1", "a"); !ok {
+		t.Fatal("expected derivative to be cached")
+	}
+
+	if len(c.flights) != 0 {
+		t.Fatalf("expected released reservations to be removed but found %d", len(c.flights))
+	}
+}
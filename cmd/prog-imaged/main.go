@@ -2,12 +2,54 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"runtime"
 
 	"github.com/vedhavyas/prog-image"
 )
 
-var addr = flag.String("addr", ":8080", "server address")
+var (
+	addr        = flag.String("addr", ":8080", "server address")
+	adminAddr   = flag.String("admin-addr", "", "address serving the expvar metrics at /debug/vars, empty disables it, eg: localhost:8081")
+	storeType   = flag.String("store", "file", "image store backend [file|s3]")
+	storePath   = flag.String("store-path", "./images", "directory for the file store")
+	s3Endpoint  = flag.String("s3-endpoint", "", "endpoint of the s3 store, eg: http://localhost:9000")
+	s3Region    = flag.String("s3-region", "us-east-1", "region of the s3 store")
+	s3Bucket    = flag.String("s3-bucket", "", "bucket of the s3 store")
+	s3Prefix    = flag.String("s3-prefix", "", "key prefix for the images in the s3 store")
+	indexPath   = flag.String("index", "./index.db", "path of the image metadata index, empty disables indexing")
+	cacheSize   = flag.Int64("cache-size", 64, "size of the in-memory cache of transformed images in MB")
+	cacheDir    = flag.String("cache-dir", "", "directory to cache transformed images on disk, empty disables disk cache")
+	workers     = flag.Int("workers", runtime.NumCPU(), "number of concurrent image transformations")
+	queueSize   = flag.Int("queue-size", 64, "number of image transformations that can wait for a worker")
+	quality     = flag.Int("quality", 75, "default jpeg and webp quality")
+	minQuality  = flag.Int("min-quality", 1, "lowest jpeg and webp quality that can be requested")
+	maxQuality  = flag.Int("max-quality", 100, "highest jpeg and webp quality that can be requested")
+	compression = flag.String("compression", "default", "default png compression [none|fast|default|best]")
+	background  = flag.String("bg", "ffffff", "default background colour for the removed alpha in RRGGBB hex form")
+	stripMeta   = flag.String("strip-metadata", "none", "metadata removed from the uploaded images [none|private|all]")
+)
+
+// getStore returns the image store selected through flags
+func getStore() (progimg.ImageStore, error) {
+	switch *storeType {
+	case "file":
+		return progimg.NewFileStore(*storePath)
+	case "s3":
+		return progimg.NewS3Store(progimg.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	}
+
+	return nil, fmt.Errorf("unknown image store: %s", *storeType)
+}
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
@@ -17,5 +59,52 @@ func main() {
 		log.Fatalf("invalid server adress: %s", *addr)
 	}
 
-	progimg.StartImageServer(*addr)
+	store, err := getStore()
+	if err != nil {
+		log.Fatalf("failed to create image store: %v", err)
+	}
+
+	var index *progimg.Index
+	if *indexPath != "" {
+		index, err = progimg.OpenIndex(*indexPath)
+		if err != nil {
+			log.Fatalf("failed to open index: %v", err)
+		}
+	}
+
+	cache, err := progimg.NewCache(*cacheSize<<20, *cacheDir)
+	if err != nil {
+		log.Fatalf("failed to create cache: %v", err)
+	}
+
+	err = progimg.StartImageServer(progimg.Config{
+		Addr:  *addr,
+		Admin: *adminAddr,
+		Store: store,
+		Index: index,
+		Cache: cache,
+
+		Workers:   *workers,
+		QueueSize: *queueSize,
+
+		Quality:     *quality,
+		MinQuality:  *minQuality,
+		MaxQuality:  *maxQuality,
+		Compression: *compression,
+		Background:  *background,
+
+		StripMetadata: *stripMeta,
+	})
+
+	// closed before exiting as deferred calls don't run on log.Fatal
+	if index != nil {
+		cerr := index.Close()
+		if cerr != nil {
+			log.Printf("failed to close index: %v\n", cerr)
+		}
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
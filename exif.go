@@ -0,0 +1,703 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// exif tags
+const (
+	tagMake              = 0x010f // tagMake: camera manufacturer
+	tagModel             = 0x0110 // tagModel: camera model
+	tagOrientation       = 0x0112 // tagOrientation: orientation of the pixels, 1 is upright
+	tagSoftware          = 0x0131 // tagSoftware: software that created the image
+	tagDateTime          = 0x0132 // tagDateTime: last modification time
+	tagXMP               = 0x02bc // tagXMP: xmp packet of a tiff
+	tagExposureTime      = 0x829a // tagExposureTime: exposure time in seconds
+	tagFNumber           = 0x829d // tagFNumber: f number of the lens
+	tagIPTC              = 0x83bb // tagIPTC: iptc record of a tiff
+	tagExifIFD           = 0x8769 // tagExifIFD: offset of the exif directory
+	tagISO               = 0x8827 // tagISO: iso speed
+	tagGPSIFD            = 0x8825 // tagGPSIFD: offset of the gps directory
+	tagDateTimeOriginal  = 0x9003 // tagDateTimeOriginal: capture time
+	tagDateTimeDigitized = 0x9004 // tagDateTimeDigitized: digitization time
+	tagFocalLength       = 0x920a // tagFocalLength: focal length in mm
+	tagMakerNote         = 0x927c // tagMakerNote: manufacturer specific data
+	tagImageUniqueID     = 0xa420 // tagImageUniqueID: unique id of the image
+	tagCameraOwnerName   = 0xa430 // tagCameraOwnerName: owner of the camera
+	tagBodySerialNumber  = 0xa431 // tagBodySerialNumber: serial number of the camera
+	tagLensModel         = 0xa434 // tagLensModel: lens model
+	tagLensSerialNumber  = 0xa435 // tagLensSerialNumber: serial number of the lens
+)
+
+// gps tags
+const (
+	tagGPSLatitudeRef  = 0x0001 // tagGPSLatitudeRef: N or S
+	tagGPSLatitude     = 0x0002 // tagGPSLatitude: degrees, minutes and seconds
+	tagGPSLongitudeRef = 0x0003 // tagGPSLongitudeRef: E or W
+	tagGPSLongitude    = 0x0004 // tagGPSLongitude: degrees, minutes and seconds
+	tagGPSAltitudeRef  = 0x0005 // tagGPSAltitudeRef: 1 when below sea level
+	tagGPSAltitude     = 0x0006 // tagGPSAltitude: altitude in meters
+)
+
+// privateTags identify the owner, the camera or the image
+var privateTags = map[uint16]bool{
+	tagMakerNote:        true,
+	tagImageUniqueID:    true,
+	tagCameraOwnerName:  true,
+	tagBodySerialNumber: true,
+	tagLensSerialNumber: true,
+}
+
+// exifHeader prefixes the exif data in jpeg app1 segments
+var exifHeader = []byte("Exif\x00\x00")
+
+// xmpHeader prefixes the xmp packet in jpeg app1 segments
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// xmpExtensionHeader prefixes the parts of an extended xmp packet in jpeg app1 segments
+var xmpExtensionHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+// pngSignature starts every png
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngXMPKeyword is the keyword of the png text chunk holding the xmp packet
+var pngXMPKeyword = []byte("XML:com.adobe.xmp\x00")
+
+// exifTimeLayout is the layout of the exif timestamps
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// exifInfo is the commonly used exif data of an image
+type exifInfo struct {
+	Make              string   `json:"make,omitempty"`                // Make: camera manufacturer
+	Model             string   `json:"model,omitempty"`               // Model: camera model
+	LensModel         string   `json:"lens_model,omitempty"`          // LensModel: lens model
+	Software          string   `json:"software,omitempty"`            // Software: software that created the image
+	Orientation       int      `json:"orientation,omitempty"`         // Orientation: exif orientation between 1 and 8
+	DateTime          string   `json:"date_time,omitempty"`           // DateTime: last modification time
+	DateTimeOriginal  string   `json:"date_time_original,omitempty"`  // DateTimeOriginal: capture time
+	DateTimeDigitized string   `json:"date_time_digitized,omitempty"` // DateTimeDigitized: digitization time
+	ExposureTime      string   `json:"exposure_time,omitempty"`       // ExposureTime: exposure time in seconds, eg: 1/125
+	FNumber           float64  `json:"f_number,omitempty"`            // FNumber: f number of the lens
+	ISO               int      `json:"iso,omitempty"`                 // ISO: iso speed
+	FocalLength       float64  `json:"focal_length,omitempty"`        // FocalLength: focal length in mm
+	GPS               *gpsInfo `json:"gps,omitempty"`                 // GPS: location of the capture
+}
+
+// gpsInfo is the location of the capture
+type gpsInfo struct {
+	Latitude  float64  `json:"latitude"`           // Latitude: decimal degrees, negative in the south
+	Longitude float64  `json:"longitude"`          // Longitude: decimal degrees, negative in the west
+	Altitude  *float64 `json:"altitude,omitempty"` // Altitude: meters above sea level
+}
+
+// ifdTypeSizes maps the tiff field types to their size in bytes
+var ifdTypeSizes = map[uint16]uint32{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	7:  1, // UNDEFINED
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+}
+
+// ifdEntry is an entry of a tiff image file directory
+type ifdEntry struct {
+	tag   uint16 // tag: id of the field
+	typ   uint16 // typ: tiff field type
+	count uint32 // count: number of values
+	value []byte // value: raw values
+}
+
+// tiffReader reads the image file directories of tiff structured data like exif
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// newTIFFReader returns the reader and the offset of the first directory
+func newTIFFReader(data []byte) (*tiffReader, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("tiff header is too short")
+	}
+
+	r := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("unknown byte order: %q", data[:2])
+	}
+
+	if r.order.Uint16(data[2:]) != 42 {
+		return nil, 0, fmt.Errorf("invalid tiff header")
+	}
+
+	return r, r.order.Uint32(data[4:]), nil
+}
+
+// readIFD reads the directory at off and returns its entries and the offset of the next directory
+// entries of unknown types or with values outside the data are skipped
+func (r *tiffReader) readIFD(off uint32) ([]ifdEntry, uint32, error) {
+	if uint64(off)+2 > uint64(len(r.data)) {
+		return nil, 0, fmt.Errorf("directory offset %d is out of range", off)
+	}
+
+	n := uint32(r.order.Uint16(r.data[off:]))
+	end := uint64(off) + 2 + uint64(n)*12
+	if end+4 > uint64(len(r.data)) {
+		return nil, 0, fmt.Errorf("directory at %d is truncated", off)
+	}
+
+	var entries []ifdEntry
+	for i := uint32(0); i < n; i++ {
+		e, ok := r.entry(r.data[off+2+i*12:])
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, r.order.Uint32(r.data[end:]), nil
+}
+
+// entry parses the 12 byte directory entry in b
+// the value shares the bytes of the data
+func (r *tiffReader) entry(b []byte) (ifdEntry, bool) {
+	e := ifdEntry{
+		tag:   r.order.Uint16(b),
+		typ:   r.order.Uint16(b[2:]),
+		count: r.order.Uint32(b[4:]),
+	}
+
+	size, ok := ifdTypeSizes[e.typ]
+	if !ok {
+		return e, false
+	}
+
+	vs := uint64(size) * uint64(e.count)
+	if vs <= 4 {
+		e.value = b[8 : 8+vs]
+		return e, true
+	}
+
+	vo := uint64(r.order.Uint32(b[8:]))
+	if vo+vs > uint64(len(r.data)) {
+		return e, false
+	}
+
+	e.value = r.data[vo : vo+vs]
+	return e, true
+}
+
+// removeEntries removes the entries of the directory at off for which drop returns true
+// the values of the removed entries and the directories they point to are zeroed
+// the data keeps its size so that the other offsets stay valid
+func (r *tiffReader) removeEntries(off uint32, drop func(tag uint16) bool) error {
+	entries, next, err := r.readIFD(off)
+	if err != nil {
+		return err
+	}
+
+	n := int(r.order.Uint16(r.data[off:]))
+	var kept [][]byte
+	for i := 0; i < n; i++ {
+		b := r.data[int(off)+2+i*12:][:12]
+		if !drop(r.order.Uint16(b)) {
+			kept = append(kept, append([]byte{}, b...))
+		}
+	}
+
+	for _, e := range entries {
+		if !drop(e.tag) {
+			continue
+		}
+
+		if e.tag == tagExifIFD || e.tag == tagGPSIFD {
+			if ptr, ok := r.uint(e, 0); ok {
+				r.zeroIFD(ptr)
+			}
+		}
+
+		zero(e.value)
+	}
+
+	ifd := r.data[off : int(off)+2+n*12+4]
+	zero(ifd)
+	r.order.PutUint16(ifd, uint16(len(kept)))
+	for i, b := range kept {
+		copy(ifd[2+i*12:], b)
+	}
+
+	r.order.PutUint32(ifd[2+len(kept)*12:], next)
+	return nil
+}
+
+// zeroIFD zeroes the directory at off and the values of its entries
+func (r *tiffReader) zeroIFD(off uint32) {
+	entries, _, err := r.readIFD(off)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		zero(e.value)
+	}
+
+	n := int(r.order.Uint16(r.data[off:]))
+	zero(r.data[off : int(off)+2+n*12+4])
+}
+
+// zero sets all the bytes of b to 0
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// uint returns the ith value of a BYTE, SHORT or LONG entry
+func (r *tiffReader) uint(e ifdEntry, i int) (uint32, bool) {
+	if i < 0 || uint32(i) >= e.count {
+		return 0, false
+	}
+
+	switch e.typ {
+	case 1:
+		return uint32(e.value[i]), true
+	case 3:
+		return uint32(r.order.Uint16(e.value[i*2:])), true
+	case 4:
+		return r.order.Uint32(e.value[i*4:]), true
+	}
+
+	return 0, false
+}
+
+// rational returns the ith value of a RATIONAL or SRATIONAL entry
+func (r *tiffReader) rational(e ifdEntry, i int) (float64, bool) {
+	if (e.typ != 5 && e.typ != 10) || i < 0 || uint32(i) >= e.count {
+		return 0, false
+	}
+
+	num, den := r.order.Uint32(e.value[i*8:]), r.order.Uint32(e.value[i*8+4:])
+	if den == 0 {
+		return 0, false
+	}
+
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+
+	return float64(num) / float64(den), true
+}
+
+// string returns the value of an ASCII entry without the trailing nul and spaces
+func (r *tiffReader) string(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+
+	return strings.TrimRight(string(e.value), "\x00 ")
+}
+
+// exifData returns the tiff structured exif data of the image, nil if there is none
+func exifData(img *Image) []byte {
+	switch img.Format {
+	case "jpeg":
+		return jpegEXIF(img.Data)
+	case "webp":
+		return webpEXIF(img.Data)
+	case "tiff":
+		return img.Data
+	}
+
+	return nil
+}
+
+// walkJPEG calls fn with the marker, the payload and the whole of each segment
+// before the image data and returns the offset of the image data
+// walking stops when fn returns false
+func walkJPEG(data []byte, fn func(marker byte, payload, seg []byte) bool) (int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, fmt.Errorf("missing jpeg start of image")
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 0, fmt.Errorf("invalid jpeg marker at %d", i)
+		}
+
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			if !fn(marker, nil, data[i:i+2]) {
+				return i, nil
+			}
+
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			return i, nil
+		}
+
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 0, fmt.Errorf("jpeg segment at %d is truncated", i)
+		}
+
+		if !fn(marker, data[i+4:i+2+size], data[i:i+2+size]) {
+			return i, nil
+		}
+
+		i += 2 + size
+	}
+
+	return 0, fmt.Errorf("missing jpeg image data")
+}
+
+// jpegEXIF returns the exif data from the app1 segment of the jpeg
+func jpegEXIF(data []byte) []byte {
+	var exif []byte
+	walkJPEG(data, func(marker byte, payload, _ []byte) bool {
+		if marker == 0xe1 && bytes.HasPrefix(payload, exifHeader) {
+			exif = payload[len(exifHeader):]
+			return false
+		}
+
+		return true
+	})
+
+	return exif
+}
+
+// xmpData returns the xmp packet of the image, nil if there is none
+func xmpData(img *Image) []byte {
+	var xmp []byte
+	switch img.Format {
+	case "jpeg":
+		walkJPEG(img.Data, func(marker byte, payload, _ []byte) bool {
+			if marker == 0xe1 && bytes.HasPrefix(payload, xmpHeader) {
+				xmp = payload[len(xmpHeader):]
+				return false
+			}
+
+			return true
+		})
+	case "png":
+		xmp = pngXMP(img.Data)
+	case "webp":
+		xmp = webpChunkData(img.Data, "XMP ")
+	case "tiff":
+		r, off, err := newTIFFReader(img.Data)
+		if err != nil {
+			return nil
+		}
+
+		entries, _, _ := r.readIFD(off)
+		for _, e := range entries {
+			if e.tag == tagXMP {
+				xmp = e.value
+			}
+		}
+	}
+
+	return xmp
+}
+
+// webpEXIF returns the data of the EXIF chunk of the webp
+// some encoders keep the jpeg exif header
+func webpEXIF(data []byte) []byte {
+	return bytes.TrimPrefix(webpChunkData(data, "EXIF"), exifHeader)
+}
+
+// walkPNG calls fn with the type, the data and the whole of each chunk of the png
+// walking stops when fn returns false
+func walkPNG(data []byte, fn func(typ string, chunk, raw []byte) bool) error {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return fmt.Errorf("missing png signature")
+	}
+
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return fmt.Errorf("png chunk at %d is truncated", i)
+		}
+
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + size
+		if size < 0 || end > len(data) {
+			return fmt.Errorf("png chunk at %d is truncated", i)
+		}
+
+		if !fn(string(data[i+4:i+8]), data[i+8:end-4], data[i:end]) {
+			return nil
+		}
+
+		i = end
+	}
+
+	return nil
+}
+
+// pngXMP returns the xmp packet of the uncompressed XML:com.adobe.xmp text chunk of the png
+func pngXMP(data []byte) []byte {
+	var xmp []byte
+	walkPNG(data, func(typ string, chunk, _ []byte) bool {
+		if typ != "iTXt" || !bytes.HasPrefix(chunk, pngXMPKeyword) {
+			return true
+		}
+
+		// compression flag and method, then the nul terminated language and translated keyword
+		rest := chunk[len(pngXMPKeyword):]
+		if len(rest) < 2 || rest[0] != 0 {
+			return false
+		}
+
+		parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+		if len(parts) == 3 {
+			xmp = parts[2]
+		}
+
+		return false
+	})
+
+	return xmp
+}
+
+// webpChunks returns the chunks of the webp riff container
+func webpChunks(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("missing webp riff header")
+	}
+
+	var chunks []webpChunk
+	for i := 12; i+8 <= len(data); {
+		fourCC, size := string(data[i:i+4]), int(binary.LittleEndian.Uint32(data[i+4:]))
+		i += 8
+		if size < 0 || i+size > len(data) {
+			return nil, fmt.Errorf("webp chunk %q is truncated", fourCC)
+		}
+
+		chunks = append(chunks, webpChunk{fourCC, data[i : i+size]})
+		i += size + size&1
+	}
+
+	return chunks, nil
+}
+
+// webpChunkData returns the data of the first chunk of the webp with fourCC
+func webpChunkData(data []byte, fourCC string) []byte {
+	chunks, _ := webpChunks(data)
+	for _, c := range chunks {
+		if c.fourCC == fourCC {
+			return c.data
+		}
+	}
+
+	return nil
+}
+
+// exifOrientation returns the exif orientation of the image between 1 and 8
+// images without a valid orientation are upright
+func exifOrientation(img *Image) int {
+	r, off, err := newTIFFReader(exifData(img))
+	if err != nil {
+		return 1
+	}
+
+	entries, _, err := r.readIFD(off)
+	if err != nil {
+		return 1
+	}
+
+	for _, e := range entries {
+		if e.tag != tagOrientation {
+			continue
+		}
+
+		o, ok := r.uint(e, 0)
+		if ok && o >= 1 && o <= 8 {
+			return int(o)
+		}
+	}
+
+	return 1
+}
+
+// parseEXIF parses the commonly used tags of the exif data
+func parseEXIF(data []byte) (*exifInfo, error) {
+	r, off, err := newTIFFReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, _, err := r.readIFD(off)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &exifInfo{}
+	for _, e := range entries {
+		ptr, _ := r.uint(e, 0)
+		switch e.tag {
+		case tagExifIFD:
+			sub, _, err := r.readIFD(ptr)
+			if err == nil {
+				entries = append(entries, sub...)
+			}
+		case tagGPSIFD:
+			gps, _, err := r.readIFD(ptr)
+			if err == nil {
+				info.GPS = r.gps(gps)
+			}
+		}
+	}
+
+	for _, e := range entries {
+		switch e.tag {
+		case tagMake:
+			info.Make = r.string(e)
+		case tagModel:
+			info.Model = r.string(e)
+		case tagLensModel:
+			info.LensModel = r.string(e)
+		case tagSoftware:
+			info.Software = r.string(e)
+		case tagOrientation:
+			o, _ := r.uint(e, 0)
+			info.Orientation = int(o)
+		case tagDateTime:
+			info.DateTime = exifTime(r.string(e))
+		case tagDateTimeOriginal:
+			info.DateTimeOriginal = exifTime(r.string(e))
+		case tagDateTimeDigitized:
+			info.DateTimeDigitized = exifTime(r.string(e))
+		case tagExposureTime:
+			if e.typ == 5 && len(e.value) >= 8 {
+				num, den := r.order.Uint32(e.value), r.order.Uint32(e.value[4:])
+				if den != 0 {
+					info.ExposureTime = fmt.Sprintf("%d/%d", num, den)
+				}
+			}
+		case tagFNumber:
+			info.FNumber, _ = r.rational(e, 0)
+		case tagISO:
+			iso, _ := r.uint(e, 0)
+			info.ISO = int(iso)
+		case tagFocalLength:
+			info.FocalLength, _ = r.rational(e, 0)
+		}
+	}
+
+	return info, nil
+}
+
+// gps returns the location of the gps directory, nil when the location is missing
+func (r *tiffReader) gps(entries []ifdEntry) *gpsInfo {
+	var lat, lon, alt *float64
+	var latRef, lonRef string
+	var below bool
+	for _, e := range entries {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = r.string(e)
+		case tagGPSLatitude:
+			lat = r.degrees(e)
+		case tagGPSLongitudeRef:
+			lonRef = r.string(e)
+		case tagGPSLongitude:
+			lon = r.degrees(e)
+		case tagGPSAltitudeRef:
+			ref, _ := r.uint(e, 0)
+			below = ref == 1
+		case tagGPSAltitude:
+			if v, ok := r.rational(e, 0); ok {
+				alt = &v
+			}
+		}
+	}
+
+	if lat == nil || lon == nil {
+		return nil
+	}
+
+	gps := &gpsInfo{Latitude: *lat, Longitude: *lon, Altitude: alt}
+	if latRef == "S" {
+		gps.Latitude = -gps.Latitude
+	}
+
+	if lonRef == "W" {
+		gps.Longitude = -gps.Longitude
+	}
+
+	if below && alt != nil {
+		*gps.Altitude = -*alt
+	}
+
+	return gps
+}
+
+// degrees returns the decimal degrees of the degrees, minutes and seconds entry
+func (r *tiffReader) degrees(e ifdEntry) *float64 {
+	var d float64
+	for i, div := range []float64{1, 60, 3600} {
+		v, ok := r.rational(e, i)
+		if !ok {
+			return nil
+		}
+
+		d += v / div
+	}
+
+	return &d
+}
+
+// exifTime converts the exif timestamp to iso 8601 form, unknown forms are kept
+func exifTime(v string) string {
+	t, err := time.Parse(exifTimeLayout, v)
+	if err != nil {
+		return v
+	}
+
+	return t.Format("2006-01-02T15:04:05")
+}
+
+// stripPrivateEXIF removes the gps directory and the private tags of the exif data in place
+// the xmp and iptc tags of the first directory are removed as they can repeat them
+func stripPrivateEXIF(data []byte) error {
+	r, off, err := newTIFFReader(data)
+	if err != nil {
+		return err
+	}
+
+	entries, _, err := r.readIFD(off)
+	if err != nil {
+		return err
+	}
+
+	isPrivate := func(tag uint16) bool { return privateTags[tag] }
+	for _, e := range entries {
+		if e.tag != tagExifIFD {
+			continue
+		}
+
+		ptr, _ := r.uint(e, 0)
+		err = r.removeEntries(ptr, isPrivate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.removeEntries(off, func(tag uint16) bool {
+		return tag == tagGPSIFD || tag == tagXMP || tag == tagIPTC || privateTags[tag]
+	})
+}
@@ -0,0 +1,280 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"reflect"
+	"testing"
+)
+
+// testEXIF returns tiff structured exif data with the orientation in byte order
+func testEXIF(order binary.ByteOrder, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+
+	binary.Write(&buf, order, uint16(42))
+	binary.Write(&buf, order, uint32(8))
+	binary.Write(&buf, order, uint16(1))
+	binary.Write(&buf, order, []uint16{tagOrientation, 3})
+	binary.Write(&buf, order, uint32(1))
+	binary.Write(&buf, order, []uint16{orientation, 0})
+	binary.Write(&buf, order, uint32(0))
+	return buf.Bytes()
+}
+
+// withJPEGEXIF inserts an app1 segment with exif data after the start of the jpeg
+func withJPEGEXIF(data, exif []byte) []byte {
+	seg := append(append([]byte{}, exifHeader...), exif...)
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	buf.Write([]byte{0xff, 0xe1})
+	binary.Write(&buf, binary.BigEndian, uint16(len(seg)+2))
+	buf.Write(seg)
+	buf.Write(data[2:])
+	return buf.Bytes()
+}
+
+// withWebPEXIF wraps the chunks of the webp in an extended container with the exif data
+func withWebPEXIF(t *testing.T, data, exif []byte) []byte {
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: decode config: %v", err)
+	}
+
+	chunks, err := webpChunks(data)
+	if err != nil {
+		t.Fatalf("unexpected error: webp chunks: %v", err)
+	}
+
+	w, h := c.Width-1, c.Height-1
+	vp8x := []byte{1 << 3, 0, 0, 0, byte(w), byte(w >> 8), byte(w >> 16), byte(h), byte(h >> 8), byte(h >> 16)}
+	chunks = append([]webpChunk{{"VP8X", vp8x}}, chunks...)
+	chunks = append(chunks, webpChunk{"EXIF", exif})
+	var buf bytes.Buffer
+	writeWebP(&buf, chunks...)
+	return buf.Bytes()
+}
+
+func Test_exifOrientation(t *testing.T) {
+	jpg, err := encodeImage(testImage(20, 10), "jpeg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	tiffData, err := encodeImage(testImage(20, 10), "tiff", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	tests := []struct {
+		img *Image
+		o   int
+	}{
+		{
+			img: newImage("jpeg", jpg),
+			o:   1,
+		},
+
+		{
+			img: newImage("jpeg", withJPEGEXIF(jpg, testEXIF(binary.LittleEndian, 6))),
+			o:   6,
+		},
+
+		{
+			img: newImage("jpeg", withJPEGEXIF(jpg, testEXIF(binary.BigEndian, 8))),
+			o:   8,
+		},
+
+		{
+			img: newImage("jpeg", withJPEGEXIF(jpg, testEXIF(binary.BigEndian, 9))),
+			o:   1,
+		},
+
+		{
+			img: newImage("jpeg", withJPEGEXIF(jpg, []byte("MM\x00*\x00\x00\xff\xff"))),
+			o:   1,
+		},
+
+		{
+			img: newImage("tiff", tiffData),
+			o:   1,
+		},
+
+		{
+			img: newImage("png", []byte("\x89PNG")),
+			o:   1,
+		},
+	}
+
+	for i, c := range tests {
+		o := exifOrientation(c.img)
+		if o != c.o {
+			t.Fatalf("%d: expected orientation %d but got %d", i, c.o, o)
+		}
+	}
+}
+
+// testTag is a tag of the test exif data
+// value is a string for ASCII, uint16 for SHORT, uint32 for LONG and numerator, denominator pairs for RATIONAL
+type testTag struct {
+	tag   uint16
+	value interface{}
+}
+
+// buildEXIF returns tiff structured exif data with the tags of the directories
+// the exif and gps directories are linked from the first directory when present
+func buildEXIF(order binary.ByteOrder, ifd0, exif, gps []testTag) []byte {
+	ifds := [][]testTag{append([]testTag{}, ifd0...), exif, gps}
+	if len(exif) > 0 {
+		ifds[0] = append(ifds[0], testTag{tagExifIFD, uint32(0)})
+	}
+
+	if len(gps) > 0 {
+		ifds[0] = append(ifds[0], testTag{tagGPSIFD, uint32(0)})
+	}
+
+	offs := make([]uint32, len(ifds))
+	off := uint32(8)
+	for i, ifd := range ifds {
+		if len(ifd) == 0 {
+			continue
+		}
+
+		offs[i] = off
+		off += uint32(2 + 12*len(ifd) + 4)
+	}
+
+	for i, t := range ifds[0] {
+		switch t.tag {
+		case tagExifIFD:
+			ifds[0][i].value = offs[1]
+		case tagGPSIFD:
+			ifds[0][i].value = offs[2]
+		}
+	}
+
+	var head, values bytes.Buffer
+	head.Write(testEXIF(order, 1)[:4])
+	binary.Write(&head, order, uint32(8))
+	for _, ifd := range ifds {
+		if len(ifd) == 0 {
+			continue
+		}
+
+		binary.Write(&head, order, uint16(len(ifd)))
+		for _, t := range ifd {
+			var typ uint16
+			var count uint32
+			var v bytes.Buffer
+			switch tv := t.value.(type) {
+			case string:
+				typ, count = 2, uint32(len(tv)+1)
+				v.WriteString(tv + "\x00")
+			case uint16:
+				typ, count = 3, 1
+				binary.Write(&v, order, tv)
+			case uint32:
+				typ, count = 4, 1
+				binary.Write(&v, order, tv)
+			case []uint32:
+				typ, count = 5, uint32(len(tv)/2)
+				binary.Write(&v, order, tv)
+			}
+
+			binary.Write(&head, order, []uint16{t.tag, typ})
+			binary.Write(&head, order, count)
+			if v.Len() <= 4 {
+				head.Write(append(v.Bytes(), make([]byte, 4-v.Len())...))
+				continue
+			}
+
+			binary.Write(&head, order, off+uint32(values.Len()))
+			values.Write(v.Bytes())
+		}
+
+		binary.Write(&head, order, uint32(0))
+	}
+
+	return append(head.Bytes(), values.Bytes()...)
+}
+
+// testCameraEXIF returns the exif data of a photo taken with a located camera
+func testCameraEXIF(order binary.ByteOrder) []byte {
+	return buildEXIF(order,
+		[]testTag{
+			{tagMake, "Canon"},
+			{tagModel, "Canon EOS 5D"},
+			{tagOrientation, uint16(1)},
+		},
+		[]testTag{
+			{tagExposureTime, []uint32{1, 125}},
+			{tagFNumber, []uint32{28, 10}},
+			{tagISO, uint16(200)},
+			{tagDateTimeOriginal, "2020:05:06 07:08:09"},
+			{tagBodySerialNumber, "SN1234567"},
+		},
+		[]testTag{
+			{tagGPSLatitudeRef, "N"},
+			{tagGPSLatitude, []uint32{12, 1, 30, 1, 0, 1}},
+			{tagGPSLongitudeRef, "W"},
+			{tagGPSLongitude, []uint32{45, 1, 15, 1, 0, 1}},
+			{tagGPSAltitude, []uint32{100, 1}},
+		})
+}
+
+func Test_parseEXIF(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		info, err := parseEXIF(testCameraEXIF(order))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		alt := 100.0
+		e := &exifInfo{
+			Make:             "Canon",
+			Model:            "Canon EOS 5D",
+			Orientation:      1,
+			DateTimeOriginal: "2020-05-06T07:08:09",
+			ExposureTime:     "1/125",
+			FNumber:          2.8,
+			ISO:              200,
+			GPS:              &gpsInfo{Latitude: 12.5, Longitude: -45.25, Altitude: &alt},
+		}
+
+		if !reflect.DeepEqual(info, e) {
+			t.Fatalf("expected %+v but got %+v", e, info)
+		}
+	}
+
+	_, err := parseEXIF([]byte("not exif"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func Test_stripPrivateEXIF(t *testing.T) {
+	data := testCameraEXIF(binary.BigEndian)
+	size := len(data)
+	err := stripPrivateEXIF(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err := parseEXIF(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if info.GPS != nil || info.Make != "Canon" || info.ISO != 200 || len(data) != size {
+		t.Fatalf("unexpected exif after strip: %+v", info)
+	}
+
+	if bytes.Contains(data, []byte("SN1234567")) {
+		t.Fatalf("expected the serial number to be removed")
+	}
+}
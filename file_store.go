@@ -0,0 +1,208 @@
+package progimg
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileStore stores the images as gob encoded files under dir
+type fileStore struct {
+	dir string
+}
+
+// fileHeader is encoded before the image so its details are read without decoding the data
+// files written before the header was added start with the image and decode to an empty etag
+type fileHeader struct {
+	Format string // Format: image format
+	Size   int64  // Size: size of the image data in bytes
+	ETag   string // ETag: sha256 of the image data
+}
+
+// NewFileStore returns an ImageStore that keeps gob encoded images under dir
+func NewFileStore(dir string) (ImageStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store dir %s: %v", dir, err)
+	}
+
+	return &fileStore{dir: dir}, nil
+}
+
+// path constructs the image path
+func (fs *fileStore) path(id string) (string, error) {
+	if !validID(id) {
+		return "", fmt.Errorf("invalid image id: %s", id)
+	}
+
+	return filepath.Join(fs.dir, id), nil
+}
+
+// Put will save the header and the image using gob encoding
+// the image is written to a temporary file and renamed over the old one
+// so readers never see a partially written image
+func (fs *fileStore) Put(img *Image) error {
+	path, err := fs.path(img.ID)
+	if err != nil {
+		return err
+	}
+
+	// temporary files are hidden from List and removed unless renamed
+	f, err := ioutil.TempFile(fs.dir, "."+img.ID+".")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %v", path, err)
+	}
+	defer os.Remove(f.Name())
+
+	enc := gob.NewEncoder(f)
+	err = enc.Encode(fileHeader{Format: img.Format, Size: int64(len(img.Data)), ETag: sha256Hex(img.Data)})
+	if err == nil {
+		err = enc.Encode(img)
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write image %s: %v", img.ID, err)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to rename file %s: %v", f.Name(), err)
+	}
+
+	return nil
+}
+
+// open opens the image file and decodes its header
+func (fs *fileStore) open(id string) (*os.File, *gob.Decoder, *fileHeader, error) {
+	path, err := fs.path(id)
+	if err != nil {
+		return nil, nil, nil, ErrImageNotFound
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil, ErrImageNotFound
+		}
+
+		return nil, nil, nil, fmt.Errorf("failed to open file %s: %v", path, err)
+	}
+
+	dec := gob.NewDecoder(f)
+	var h fileHeader
+	err = dec.Decode(&h)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("failed to decode image %s: %v", id, err)
+	}
+
+	return f, dec, &h, nil
+}
+
+// Get will extract the image from the file using gob decoder
+func (fs *fileStore) Get(id string) (*Image, error) {
+	f, dec, h, err := fs.open(id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	if h.ETag == "" {
+		// the header was the image itself
+		_, err = f.Seek(0, io.SeekStart)
+		dec = gob.NewDecoder(f)
+	}
+
+	var img Image
+	if err == nil {
+		err = dec.Decode(&img)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image %s: %v", id, err)
+	}
+
+	return &img, nil
+}
+
+// Delete removes the image file
+func (fs *fileStore) Delete(id string) error {
+	path, err := fs.path(id)
+	if err != nil {
+		return ErrImageNotFound
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrImageNotFound
+		}
+
+		return fmt.Errorf("failed to remove file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Stat returns the details of the image from the file header
+// files without a header are decoded to hash the image data
+func (fs *fileStore) Stat(id string) (*ImageStat, error) {
+	f, _, h, err := fs.open(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %v", f.Name(), err)
+	}
+
+	if h.ETag == "" {
+		img, err := fs.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		h = &fileHeader{Format: img.Format, Size: int64(len(img.Data)), ETag: sha256Hex(img.Data)}
+	}
+
+	return &ImageStat{
+		ID:      id,
+		Format:  h.Format,
+		Size:    h.Size,
+		ModTime: fi.ModTime(),
+		ETag:    h.ETag,
+	}, nil
+}
+
+// List returns the ids of all the image files under dir
+func (fs *fileStore) List() ([]string, error) {
+	fis, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store dir %s: %v", fs.dir, err)
+	}
+
+	var ids []string
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		ids = append(ids, fi.Name())
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,164 @@
+package progimg
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func tempFileStore(t *testing.T) (ImageStore, func()) {
+	dir, err := ioutil.TempDir("", "prog-image")
+	if err != nil {
+		t.Fatalf("unexpected error: temp dir: %v", err)
+	}
+
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: file store: %v", err)
+	}
+
+	return fs, func() { os.RemoveAll(dir) }
+}
+
+func Test_fileStore(t *testing.T) {
+	fs, done := tempFileStore(t)
+	defer done()
+
+	tests := []*Image{
+		{
+			ID:     "12345",
+			Format: "png",
+			Data:   []byte{1, 200, 32, 23},
+		},
+
+		{
+			ID:     "67890",
+			Format: "jpeg",
+			Data:   []byte{1, 23, 12},
+		},
+	}
+
+	for _, i := range tests {
+		err := fs.Put(i)
+		if err != nil {
+			t.Fatalf("unexpected error: put image: %v", err)
+		}
+
+		img, err := fs.Get(i.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: get image: %v", err)
+		}
+
+		if !reflect.DeepEqual(i, img) {
+			t.Fatal("unexpected error: image mismatch")
+		}
+
+		st, err := fs.Stat(i.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: stat image: %v", err)
+		}
+
+		if st.Format != i.Format || st.Size != int64(len(i.Data)) || st.ETag != sha256Hex(i.Data) {
+			t.Fatalf("unexpected error: stat mismatch: %+v", st)
+		}
+	}
+
+	ids, err := fs.List()
+	if err != nil {
+		t.Fatalf("unexpected error: list images: %v", err)
+	}
+
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"12345", "67890"}) {
+		t.Fatalf("unexpected error: list mismatch: %v", ids)
+	}
+
+	// replacing an image leaves no temporary files behind
+	err = fs.Put(&Image{ID: "12345", Format: "gif", Data: []byte{7}})
+	if err != nil {
+		t.Fatalf("unexpected error: replace image: %v", err)
+	}
+
+	img, err := fs.Get("12345")
+	if err != nil || img.Format != "gif" {
+		t.Fatalf("unexpected error: replaced image mismatch: %v", err)
+	}
+
+	fis, err := ioutil.ReadDir(fs.(*fileStore).dir)
+	if err != nil || len(fis) != 2 {
+		t.Fatalf("unexpected error: expected 2 files but got %d: %v", len(fis), err)
+	}
+
+	err = fs.Delete("12345")
+	if err != nil {
+		t.Fatalf("unexpected error: delete image: %v", err)
+	}
+
+	for _, id := range []string{"12345", "unknown", "..", "../images"} {
+		if _, err := fs.Get(id); err != ErrImageNotFound {
+			t.Fatalf("expected not found for %s but got %v", id, err)
+		}
+
+		if err := fs.Delete(id); err != ErrImageNotFound {
+			t.Fatalf("expected not found for %s but got %v", id, err)
+		}
+	}
+}
+
+func Test_fileStore_Stat(t *testing.T) {
+	fs, done := tempFileStore(t)
+	defer done()
+
+	write := func(id string, values ...interface{}) {
+		f, err := os.Create(filepath.Join(fs.(*fileStore).dir, id))
+		if err != nil {
+			t.Fatalf("unexpected error: create: %v", err)
+		}
+
+		defer f.Close()
+		enc := gob.NewEncoder(f)
+		for _, v := range values {
+			if b, ok := v.([]byte); ok {
+				f.Write(b)
+				continue
+			}
+
+			err = enc.Encode(v)
+			if err != nil {
+				t.Fatalf("unexpected error: encode: %v", err)
+			}
+		}
+	}
+
+	// stat reads the header alone and never decodes the image data
+	write("corrupt", fileHeader{Format: "png", Size: 3, ETag: "abc"}, []byte("not an image"))
+	st, err := fs.Stat("corrupt")
+	if err != nil || st.Format != "png" || st.Size != 3 || st.ETag != "abc" {
+		t.Fatalf("unexpected error: stat mismatch: %+v: %v", st, err)
+	}
+
+	if _, err := fs.Get("corrupt"); err == nil {
+		t.Fatalf("expected an error for the corrupt image data")
+	}
+
+	// images written without a header are still read
+	legacy := &Image{ID: "legacy", Format: "jpeg", Data: []byte{1, 2, 3}}
+	write("legacy", legacy)
+	img, err := fs.Get("legacy")
+	if err != nil || !reflect.DeepEqual(img, legacy) {
+		t.Fatalf("unexpected error: legacy image mismatch: %v", err)
+	}
+
+	st, err = fs.Stat("legacy")
+	if err != nil || st.Format != "jpeg" || st.Size != 3 || st.ETag != sha256Hex(legacy.Data) {
+		t.Fatalf("unexpected error: legacy stat mismatch: %+v: %v", st, err)
+	}
+
+	if _, err := fs.Stat("unknown"); err != ErrImageNotFound {
+		t.Fatalf("expected not found but got %v", err)
+	}
+}
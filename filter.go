@@ -0,0 +1,323 @@
+package progimg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxSigma is the largest standard deviation of the blur and sharpen filters
+const maxSigma = 25
+
+// filterSpec describes the arguments and the implementation of a filter
+type filterSpec struct {
+	min, max []float64 // min, max: bounds of the arguments
+	defaults []float64 // defaults: values of the trailing arguments that can be left out
+	run      func(src image.Image, args []float64) image.Image
+}
+
+// filters maps the filter names to their spec
+var filters = map[string]filterSpec{
+	"blur": {
+		min: []float64{0.1},
+		max: []float64{maxSigma},
+		run: func(src image.Image, args []float64) image.Image {
+			return blurImage(src, args[0])
+		},
+	},
+	"sharpen": {
+		min:      []float64{0.1, 0},
+		max:      []float64{maxSigma, 10},
+		defaults: []float64{1},
+		run: func(src image.Image, args []float64) image.Image {
+			return sharpenImage(src, args[0], args[1])
+		},
+	},
+	"brightness": {
+		min: []float64{-100},
+		max: []float64{100},
+		run: func(src image.Image, args []float64) image.Image {
+			d := args[0] / 100
+			return adjustChannels(src, func(v float64) float64 { return v + d })
+		},
+	},
+	"contrast": {
+		min: []float64{-100},
+		max: []float64{100},
+		run: func(src image.Image, args []float64) image.Image {
+			f := 1 + args[0]/100
+			return adjustChannels(src, func(v float64) float64 { return (v-0.5)*f + 0.5 })
+		},
+	},
+	"gamma": {
+		min: []float64{0.1},
+		max: []float64{10},
+		run: func(src image.Image, args []float64) image.Image {
+			e := 1 / args[0]
+			return adjustChannels(src, func(v float64) float64 { return math.Pow(v, e) })
+		},
+	},
+	"saturation": {
+		min: []float64{-100},
+		max: []float64{100},
+		run: func(src image.Image, args []float64) image.Image {
+			return saturateImage(src, 1+args[0]/100)
+		},
+	},
+	"grayscale": {
+		run: func(src image.Image, _ []float64) image.Image {
+			return saturateImage(src, 0)
+		},
+	},
+	"sepia": {
+		run: func(src image.Image, _ []float64) image.Image {
+			return adjustPixels(src, func(r, g, b float64) (float64, float64, float64) {
+				return 0.393*r + 0.769*g + 0.189*b, 0.349*r + 0.686*g + 0.168*b, 0.272*r + 0.534*g + 0.131*b
+			})
+		},
+	},
+}
+
+// filterOrder is the order the filters given as queries are applied in
+var filterOrder = []string{"blur", "sharpen", "brightness", "contrast", "gamma", "saturation", "grayscale", "sepia"}
+
+// filterOp runs a filter on the image
+type filterOp struct {
+	name string    // name: name of the filter
+	args []float64 // args: arguments of the filter with the defaults filled in
+}
+
+// parseFilterOp parses the arguments of the named filter
+func parseFilterOp(name string, args []string) (*filterOp, error) {
+	spec := filters[name]
+	if len(args) > len(spec.min) || len(args) < len(spec.min)-len(spec.defaults) {
+		return nil, fmt.Errorf("expected %s", filterUsage(name))
+	}
+
+	op := &filterOp{name: name}
+	for i := range spec.min {
+		if i >= len(args) {
+			op.args = append(op.args, spec.defaults[i-(len(spec.min)-len(spec.defaults))])
+			continue
+		}
+
+		v, err := strconv.ParseFloat(args[i], 64)
+		if err != nil || math.IsNaN(v) || v < spec.min[i] || v > spec.max[i] {
+			return nil, fmt.Errorf("%s must be between %v and %v", args[i], spec.min[i], spec.max[i])
+		}
+
+		op.args = append(op.args, v)
+	}
+
+	return op, nil
+}
+
+// filterUsage returns the path form of the named filter
+func filterUsage(name string) string {
+	spec := filters[name]
+	usage := name
+	for i := range spec.min {
+		arg := fmt.Sprintf("%v-%v", spec.min[i], spec.max[i])
+		if i >= len(spec.min)-len(spec.defaults) {
+			arg = "[" + arg + "]"
+		}
+
+		usage += ":" + arg
+	}
+
+	return usage
+}
+
+// filterPathParser returns the path parser of the named filter
+func filterPathParser(name string) opParser {
+	return func(args []string) (operation, error) {
+		return parseFilterOp(name, args)
+	}
+}
+
+// parseFilterQuery parses the named filter from its query value
+// filters without arguments take a boolean and return nil when false
+func parseFilterQuery(name, v string) (*filterOp, error) {
+	if len(filters[name].min) == 0 {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("expected true or false")
+		}
+
+		if !on {
+			return nil, nil
+		}
+
+		return parseFilterOp(name, nil)
+	}
+
+	return parseFilterOp(name, strings.Split(v, ","))
+}
+
+func (op *filterOp) apply(src image.Image, _ color.Color) (image.Image, error) {
+	return filters[op.name].run(src, op.args), nil
+}
+
+func (op *filterOp) String() string {
+	s := op.name
+	for _, a := range op.args {
+		s += ":" + strconv.FormatFloat(a, 'f', -1, 64)
+	}
+
+	return s
+}
+
+// toNRGBA returns a copy of the image as non premultiplied rgba at origin
+func toNRGBA(src image.Image) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// toRGBA returns a copy of the image as premultiplied rgba at origin
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// clampUnit keeps v within 0 and 1 and scales it to a byte
+func clampUnit(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+
+	if v >= 1 {
+		return 0xff
+	}
+
+	return uint8(v*0xff + 0.5)
+}
+
+// adjustChannels maps each colour channel through fn with values between 0 and 1
+// alpha is kept as it is
+func adjustChannels(src image.Image, fn func(v float64) float64) *image.NRGBA {
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = clampUnit(fn(float64(i) / 0xff))
+	}
+
+	dst := toNRGBA(src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = lut[dst.Pix[i]], lut[dst.Pix[i+1]], lut[dst.Pix[i+2]]
+	}
+
+	return dst
+}
+
+// adjustPixels maps the colour of each pixel through fn with values between 0 and 1
+// alpha is kept as it is
+func adjustPixels(src image.Image, fn func(r, g, b float64) (float64, float64, float64)) *image.NRGBA {
+	dst := toNRGBA(src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		p := dst.Pix[i : i+3]
+		r, g, b := fn(float64(p[0])/0xff, float64(p[1])/0xff, float64(p[2])/0xff)
+		p[0], p[1], p[2] = clampUnit(r), clampUnit(g), clampUnit(b)
+	}
+
+	return dst
+}
+
+// saturateImage scales the distance of each colour from its luma by f
+// 0 turns the image to grayscale and 1 keeps it as it is
+func saturateImage(src image.Image, f float64) *image.NRGBA {
+	return adjustPixels(src, func(r, g, b float64) (float64, float64, float64) {
+		y := 0.299*r + 0.587*g + 0.114*b
+		return y + (r-y)*f, y + (g-y)*f, y + (b-y)*f
+	})
+}
+
+// gaussianKernel returns the normalized 1d gaussian kernel of sigma spanning 3 sigmas each side
+func gaussianKernel(sigma float64) []float64 {
+	r := int(math.Ceil(sigma * 3))
+	k := make([]float64, 2*r+1)
+	var sum float64
+	for i := range k {
+		x := float64(i - r)
+		k[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += k[i]
+	}
+
+	for i := range k {
+		k[i] /= sum
+	}
+
+	return k
+}
+
+// blurImage blurs the premultiplied image with a separable gaussian of sigma
+// pixels beyond the edges repeat the edge pixels
+func blurImage(src image.Image, sigma float64) *image.RGBA {
+	k := gaussianKernel(sigma)
+	return convolve(convolve(toRGBA(src), k, 1, 0), k, 0, 1)
+}
+
+// convolve runs the 1d kernel over the image along dx, dy
+func convolve(src *image.RGBA, k []float64, dx, dy int) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(src.Rect)
+	r := len(k) / 2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for i, kv := range k {
+				sx := clampIndex(x+(i-r)*dx, w)
+				sy := clampIndex(y+(i-r)*dy, h)
+				p := src.Pix[src.PixOffset(sx, sy):]
+				sum[0] += kv * float64(p[0])
+				sum[1] += kv * float64(p[1])
+				sum[2] += kv * float64(p[2])
+				sum[3] += kv * float64(p[3])
+			}
+
+			p := dst.Pix[dst.PixOffset(x, y):]
+			for c := range sum {
+				p[c] = uint8(math.Min(math.Max(sum[c]+0.5, 0), 0xff))
+			}
+		}
+	}
+
+	return dst
+}
+
+// clampIndex keeps i within 0 and n-1
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+
+	if i >= n {
+		return n - 1
+	}
+
+	return i
+}
+
+// sharpenImage sharpens the image with an unsharp mask of sigma
+// amount scales the difference between the image and its blur added back to the image
+func sharpenImage(src image.Image, sigma, amount float64) *image.RGBA {
+	dst := toRGBA(src)
+	blurred := blurImage(dst, sigma)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		// colour can't exceed alpha in premultiplied form
+		a := float64(dst.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			v := float64(dst.Pix[i+c])
+			v += amount * (v - float64(blurred.Pix[i+c]))
+			dst.Pix[i+c] = uint8(math.Min(math.Max(v+0.5, 0), a))
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,194 @@
+package progimg
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func Test_parseFilterOp(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		op   string
+		err  string
+	}{
+		{
+			name: "blur",
+			args: []string{"2.5"},
+			op:   "blur:2.5",
+		},
+
+		{
+			name: "blur",
+			args: []string{"0"},
+			err:  "0 must be between 0.1 and 25",
+		},
+
+		{
+			name: "sharpen",
+			args: []string{"1"},
+			op:   "sharpen:1:1",
+		},
+
+		{
+			name: "sharpen",
+			args: []string{"1", "2", "3"},
+			err:  "expected sharpen:0.1-25:[0-10]",
+		},
+
+		{
+			name: "brightness",
+			args: []string{"-20"},
+			op:   "brightness:-20",
+		},
+
+		{
+			name: "gamma",
+			args: []string{"NaN"},
+			err:  "NaN must be between 0.1 and 10",
+		},
+
+		{
+			name: "grayscale",
+			op:   "grayscale",
+		},
+
+		{
+			name: "sepia",
+			args: []string{"1"},
+			err:  "expected sepia",
+		},
+	}
+
+	for _, c := range tests {
+		op, err := parseFilterOp(c.name, c.args)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error: %s", c.err)
+		}
+
+		if op.String() != c.op {
+			t.Fatalf("expected %s but got %s", c.op, op)
+		}
+	}
+
+	for name := range filters {
+		found := false
+		for _, n := range filterOrder {
+			found = found || n == name
+		}
+
+		if !found {
+			t.Fatalf("filter %s can't be given as a query", name)
+		}
+	}
+}
+
+func Test_filters(t *testing.T) {
+	// dark left half and light right half with a transparent corner
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{0x20, 0x40, 0x80, 0xff}
+			if x >= 20 {
+				c = color.NRGBA{0xe0, 0xc0, 0x80, 0xff}
+			}
+
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	src.SetNRGBA(0, 0, color.NRGBA{})
+
+	tests := []struct {
+		path  string
+		at    image.Point
+		check func(c color.NRGBA) bool
+	}{
+		{
+			// blur softens the edge
+			path:  "blur:2",
+			at:    image.Pt(19, 10),
+			check: func(c color.NRGBA) bool { return c.R > 0x30 && c.R < 0xd0 },
+		},
+
+		{
+			// sharpen overshoots the edge
+			path:  "sharpen:2:2",
+			at:    image.Pt(19, 10),
+			check: func(c color.NRGBA) bool { return c.R < 0x20 },
+		},
+
+		{
+			path:  "brightness:50",
+			at:    image.Pt(5, 10),
+			check: func(c color.NRGBA) bool { return c.R == 0xa0 && c.A == 0xff },
+		},
+
+		{
+			path:  "contrast:-100",
+			at:    image.Pt(30, 10),
+			check: func(c color.NRGBA) bool { return c.R == 0x80 && c.G == 0x80 },
+		},
+
+		{
+			path:  "gamma:2",
+			at:    image.Pt(5, 10),
+			check: func(c color.NRGBA) bool { return c.B == 0xb5 },
+		},
+
+		{
+			path:  "grayscale",
+			at:    image.Pt(30, 10),
+			check: func(c color.NRGBA) bool { return c.R == c.G && c.G == c.B },
+		},
+
+		{
+			path:  "saturation:100",
+			at:    image.Pt(5, 10),
+			check: func(c color.NRGBA) bool { return c.R < 0x20 && c.B > 0x80 },
+		},
+
+		{
+			path:  "sepia",
+			at:    image.Pt(5, 10),
+			check: func(c color.NRGBA) bool { return c.R > c.G && c.G > c.B },
+		},
+
+		{
+			// alpha is kept
+			path:  "brightness:50/sepia",
+			at:    image.Pt(0, 0),
+			check: func(c color.NRGBA) bool { return c.A == 0 },
+		},
+	}
+
+	for _, c := range tests {
+		p, err := parsePathPipeline(c.path)
+		if err != nil {
+			t.Fatalf("unexpected error: parse: %v", err)
+		}
+
+		dst, err := p.apply(src)
+		if err != nil {
+			t.Fatalf("unexpected error: %s: %v", c.path, err)
+		}
+
+		if dst.Bounds().Size() != src.Bounds().Size() {
+			t.Fatalf("%s: unexpected size %v", c.path, dst.Bounds())
+		}
+
+		px := color.NRGBAModel.Convert(dst.At(c.at.X, c.at.Y)).(color.NRGBA)
+		if !c.check(px) {
+			t.Fatalf("%s: unexpected pixel %v", c.path, px)
+		}
+	}
+}
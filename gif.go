@@ -0,0 +1,223 @@
+package progimg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// renderGIF draws the frames of the animation in order on to its canvas honouring
+// the disposal modes and calls fn with the canvas after each frame is drawn
+// rendering stops when fn returns false
+func renderGIF(g *gif.GIF, fn func(i int, canvas *image.RGBA) bool) {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var prev *image.RGBA
+	for i, f := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			if prev == nil {
+				prev = image.NewRGBA(canvas.Rect)
+			}
+
+			copy(prev.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, f.Bounds(), f, f.Bounds().Min, draw.Over)
+		if !fn(i, canvas) {
+			return
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, f.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, prev.Pix)
+		}
+	}
+}
+
+// decodeGIF decodes all the frames of the gif
+// the canvas and frames x canvas are checked against the budgets before decoding
+func decodeGIF(data []byte) (*gif.GIF, error) {
+	c, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	pixels := c.Width * c.Height
+	if pixels > maxPixels {
+		return nil, fmt.Errorf("gif of %dx%d is larger than %d pixels", c.Width, c.Height, maxPixels)
+	}
+
+	frames, err := countGIFFrames(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if frames*pixels > maxAnimationPixels {
+		return nil, fmt.Errorf("gif of %d %dx%d frames is larger than %d pixels", frames, c.Width, c.Height, maxAnimationPixels)
+	}
+
+	return gif.DecodeAll(bytes.NewReader(data))
+}
+
+// countGIFFrames counts the image descriptors of the gif by skipping over the blocks without decoding them
+func countGIFFrames(data []byte) (int, error) {
+	// header and logical screen descriptor, then the global colour table
+	i := 13
+	if len(data) < i {
+		return 0, fmt.Errorf("gif header is truncated")
+	}
+
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	// skipBlocks skips the data sub-blocks from i up to the terminator
+	skipBlocks := func() {
+		for i < len(data) && data[i] != 0 {
+			i += int(data[i]) + 1
+		}
+
+		i++
+	}
+
+	var frames int
+	for i < len(data) {
+		switch data[i] {
+		case 0x21:
+			// extension introducer and label
+			i += 2
+			skipBlocks()
+		case 0x2c:
+			// image descriptor, the local colour table and the lzw minimum code size
+			if i+10 > len(data) {
+				return 0, fmt.Errorf("gif frame %d is truncated", frames+1)
+			}
+
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+
+			i++
+			skipBlocks()
+			frames++
+		case 0x3b:
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unknown gif block %#x", data[i])
+		}
+	}
+
+	// truncated gifs are decoded upto their last frame
+	return frames, nil
+}
+
+// decodeGIFFrame returns the nth frame of the gif, counting from 1, as it is displayed
+func decodeGIFFrame(data []byte, n int) (image.Image, error) {
+	g, err := decodeGIF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 || n > len(g.Image) {
+		return nil, fmt.Errorf("frame %d is out of range, image has %d frames", n, len(g.Image))
+	}
+
+	var frame image.Image
+	renderGIF(g, func(i int, canvas *image.RGBA) bool {
+		if i < n-1 {
+			return true
+		}
+
+		frame = canvas
+		return false
+	})
+
+	return frame, nil
+}
+
+// transformAnimation runs the pipeline on every frame of the gif
+// frames are rendered on the full canvas before the operations so that partial
+// frames line up after transforming, and keep their delay, disposal and palette
+// animations which would grow past maxAnimationPixels are rejected as soon as a frame shows it
+func transformAnimation(img *Image, p *pipeline) error {
+	g, err := decodeGIF(img.Data)
+	if err != nil {
+		return transformError{fmt.Errorf("failed to decode image: %v", err)}
+	}
+
+	out := &gif.GIF{
+		Delay:     g.Delay,
+		Disposal:  g.Disposal,
+		LoopCount: g.LoopCount,
+	}
+
+	var pixels int
+	renderGIF(g, func(i int, canvas *image.RGBA) bool {
+		var frame image.Image
+		frame, err = p.apply(canvas)
+		if err != nil {
+			return false
+		}
+
+		// the remaining frames are expected to come out as large as this one
+		b := frame.Bounds()
+		pixels += b.Dx() * b.Dy()
+		if pixels+(len(g.Image)-i-1)*b.Dx()*b.Dy() > maxAnimationPixels {
+			err = transformError{fmt.Errorf("animation of %d %dx%d frames is larger than %d pixels",
+				len(g.Image), b.Dx(), b.Dy(), maxAnimationPixels)}
+			return false
+		}
+
+		// nearest colour keeps the palette stable across frames unlike dithering
+		out.Image = append(out.Image, palettedImage(frame, g.Image[i].Palette, draw.Src))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, out)
+	if err != nil {
+		return transformError{fmt.Errorf("failed to convert image: %v", err)}
+	}
+
+	img.Data = buf.Bytes()
+	return nil
+}
+
+// palettedImage draws the image on to a paletted image at origin using drawer
+// a transparent colour is added when the image has transparency and the palette has room
+func palettedImage(src image.Image, pal color.Palette, drawer draw.Drawer) *image.Paletted {
+	if o, ok := src.(interface{ Opaque() bool }); (!ok || !o.Opaque()) &&
+		len(pal) < 256 && !hasTransparent(pal) {
+		pal = append(pal[:len(pal):len(pal)], color.Transparent)
+	}
+
+	b := src.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	drawer.Draw(dst, dst.Bounds(), src, b.Min)
+	return dst
+}
+
+// hasTransparent checks if the palette has a fully transparent colour
+func hasTransparent(pal color.Palette) bool {
+	for _, c := range pal {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return true
+		}
+	}
+
+	return false
+}
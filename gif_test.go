@@ -0,0 +1,255 @@
+package progimg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGIF returns a 3 frame 40x20 animation
+// the first frame fills the canvas in red and the later ones draw a 10x10 blue square
+func testGIF(t *testing.T) []byte {
+	pal := color.Palette{color.Transparent, color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}}
+	frame := func(r image.Rectangle, ci uint8) *image.Paletted {
+		f := image.NewPaletted(r, pal)
+		for i := range f.Pix {
+			f.Pix[i] = ci
+		}
+
+		return f
+	}
+
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 40, 20), 1),
+			frame(image.Rect(0, 0, 10, 10), 2),
+			frame(image.Rect(30, 10, 40, 20), 2),
+		},
+		Delay:    []int{10, 20, 30},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func Test_decodeGIFFrame(t *testing.T) {
+	data := testGIF(t)
+	red, blue := color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}
+	tests := []struct {
+		frame int
+		px    map[image.Point]color.RGBA
+		err   bool
+	}{
+		{
+			frame: 1,
+			px:    map[image.Point]color.RGBA{{5, 5}: red, {35, 15}: red},
+		},
+
+		{
+			frame: 2,
+			px:    map[image.Point]color.RGBA{{5, 5}: blue, {35, 15}: red},
+		},
+
+		{
+			// second frame is disposed to the background
+			frame: 3,
+			px:    map[image.Point]color.RGBA{{5, 5}: {}, {35, 15}: blue, {20, 10}: red},
+		},
+
+		{
+			frame: 4,
+			err:   true,
+		},
+	}
+
+	for _, c := range tests {
+		gimg, err := decodeGIFFrame(data, c.frame)
+		if err != nil {
+			if c.err {
+				continue
+			}
+
+			t.Fatalf("unexpected error: frame %d: %v", c.frame, err)
+		}
+
+		if c.err {
+			t.Fatalf("expected error for frame %d", c.frame)
+		}
+
+		if gimg.Bounds() != image.Rect(0, 0, 40, 20) {
+			t.Fatalf("unexpected error: frame bounds: %v", gimg.Bounds())
+		}
+
+		for p, want := range c.px {
+			if got := color.RGBAModel.Convert(gimg.At(p.X, p.Y)); got != want {
+				t.Fatalf("frame %d: expected %v at %v but got %v", c.frame, want, p, got)
+			}
+		}
+	}
+}
+
+func Test_transformAnimation(t *testing.T) {
+	img := newImage("gif", testGIF(t))
+	p, err := parsePathPipeline("resize:20x")
+	if err != nil {
+		t.Fatalf("unexpected error: parse: %v", err)
+	}
+
+	err = transformImage(img, p)
+	if err != nil {
+		t.Fatalf("unexpected error: transform: %v", err)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if len(g.Image) != 3 || g.Config.Width != 20 || g.Config.Height != 10 {
+		t.Fatalf("unexpected animation: %d frames of %dx%d", len(g.Image), g.Config.Width, g.Config.Height)
+	}
+
+	for i, d := range []int{10, 20, 30} {
+		if g.Delay[i] != d {
+			t.Fatalf("expected delay %d but got %d", d, g.Delay[i])
+		}
+	}
+
+	if g.Disposal[1] != gif.DisposalBackground {
+		t.Fatalf("expected background disposal but got %d", g.Disposal[1])
+	}
+
+	// single frame is extracted and converted
+	img = newImage("gif", testGIF(t))
+	err = transformImage(img, &pipeline{format: "png", frame: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: transform: %v", err)
+	}
+
+	gimg, err := getGoImage(img)
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if c := color.RGBAModel.Convert(gimg.At(5, 5)); c != (color.RGBA{0, 0, 0xff, 0xff}) {
+		t.Fatalf("expected second frame but got %v at 5,5", c)
+	}
+
+	err = transformImage(newImage("png", img.Data), &pipeline{frame: 2})
+	if _, ok := err.(transformError); !ok {
+		t.Fatalf("expected transform error but got %v", err)
+	}
+}
+
+func Test_transformAnimation_large(t *testing.T) {
+	g := &gif.GIF{}
+	for i := 0; i < 200; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black}))
+		g.Delay = append(g.Delay, 0)
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	// a tiny input within the decode budget grows to 200 frames of 2048x2048
+	p, err := parsePathPipeline("resize:2048x2048:fill")
+	if err != nil {
+		t.Fatalf("unexpected error: parse: %v", err)
+	}
+
+	err = transformImage(newImage("gif", buf.Bytes()), p)
+	if _, ok := err.(transformError); !ok || !strings.Contains(err.Error(), "animation of 200 2048x2048 frames") {
+		t.Fatalf("expected transform error but got %v", err)
+	}
+}
+
+func Test_decodeGIF(t *testing.T) {
+	encode := func(w, h, frames int) []byte {
+		g := &gif.GIF{Config: image.Config{Width: w, Height: h}}
+		for i := 0; i < frames; i++ {
+			g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}))
+			g.Delay = append(g.Delay, 0)
+		}
+
+		var buf bytes.Buffer
+		err := gif.EncodeAll(&buf, g)
+		if err != nil {
+			t.Fatalf("unexpected error: encode: %v", err)
+		}
+
+		return buf.Bytes()
+	}
+
+	// the logical screen claims 16384x16384 while the frame is 1x1
+	huge := encode(1, 1, 1)
+	huge[6], huge[7], huge[8], huge[9] = 0, 0x40, 0, 0x40
+
+	tests := []struct {
+		data   []byte
+		frames int
+		err    string
+	}{
+		{
+			data:   testGIF(t),
+			frames: 3,
+		},
+
+		{
+			data:   encode(4096, 4096, 16),
+			frames: 16,
+		},
+
+		{
+			data: huge,
+			err:  "gif of 16384x16384 is larger than",
+		},
+
+		{
+			data: encode(4096, 4096, 17),
+			err:  "gif of 17 4096x4096 frames is larger than",
+		},
+
+		{
+			data: append(encode(4, 4, 1)[:13], 0x99),
+			err:  "unknown gif block 0x99",
+		},
+	}
+
+	for _, c := range tests {
+		start := time.Now()
+		g, err := decodeGIF(c.data)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				// rejected before decoding the frames
+				if d := time.Since(start); d > time.Second {
+					t.Fatalf("rejecting took %v", d)
+				}
+
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error: %s", c.err)
+		}
+
+		if len(g.Image) != c.frames {
+			t.Fatalf("expected %d frames but got %d", c.frames, len(g.Image))
+		}
+	}
+}
@@ -39,7 +39,7 @@ func base64Handler() uploadTypeHandler {
 			return nil, fmt.Errorf("failed to decode base64 image: %v", err)
 		}
 
-		ct := http.DetectContentType(dimg)
+		ct := detectContentType(dimg)
 		if !contentTypeOK(ct) {
 			return nil, fmt.Errorf("unknown content type: %s", ct)
 		}
@@ -65,7 +65,7 @@ func urlImageHandler() uploadTypeHandler {
 
 		ct := resp.Header.Get("Content-type")
 		if ct == "" {
-			ct = http.DetectContentType(d)
+			ct = detectContentType(d)
 		}
 
 		if !contentTypeOK(ct) {
@@ -91,7 +91,7 @@ func multipartImageHandler() uploadTypeHandler {
 			return nil, fmt.Errorf("failed to read image file: %v", err)
 		}
 
-		ct := http.DetectContentType(d)
+		ct := detectContentType(d)
 		if !contentTypeOK(ct) {
 			return nil, fmt.Errorf("unknow content type: %s", ct)
 		}
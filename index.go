@@ -0,0 +1,444 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bolt buckets used by the index
+var (
+	imagesBucket  = []byte("images")     // id -> json encoded ImageMeta
+	hashBucket    = []byte("by_hash")    // hash:id -> nil
+	createdBucket = []byte("by_created") // created(unix nano, big endian)+id -> nil
+)
+
+// maxListLimit is the maximum number of images returned in a single listing
+const maxListLimit = 1000
+
+// imageIndex is the index kept in sync with the image store, nil disables indexing
+var imageIndex *Index
+
+// ImageMeta holds the indexed details of an image
+type ImageMeta struct {
+	ID        string    `json:"id"`         // ID: unique ID for image
+	Format    string    `json:"format"`     // Format: image format
+	Width     int       `json:"width"`      // Width: width of the image in pixels
+	Height    int       `json:"height"`     // Height: height of the image in pixels
+	Size      int64     `json:"size"`       // Size: size of the image data in bytes
+	CreatedAt time.Time `json:"created_at"` // CreatedAt: upload time of the image
+	Source    string    `json:"source"`     // Source: upload type of the image(base64, url, file)
+	Hash      string    `json:"hash"`       // Hash: hex encoded sha256 of the image data
+}
+
+// newImageMeta builds the metadata of the image uploaded through source
+func newImageMeta(img *Image, source string) *ImageMeta {
+	m := &ImageMeta{
+		ID:        img.ID,
+		Format:    img.Format,
+		Size:      int64(len(img.Data)),
+		CreatedAt: time.Now().UTC(),
+		Source:    source,
+		Hash:      sha256Hex(img.Data),
+	}
+
+	c, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err == nil {
+		m.Width, m.Height = c.Width, c.Height
+		if exifOrientation(img) >= 5 {
+			m.Width, m.Height = c.Height, c.Width
+		}
+	}
+
+	return m
+}
+
+// Index is a persistent metadata index of the stored images backed by bolt
+type Index struct {
+	db *bolt.DB
+}
+
+// OpenIndex opens the index at path, creating it if required
+func OpenIndex(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{imagesBucket, hashBucket, createdBucket} {
+			_, err := tx.CreateBucketIfNotExists(b)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create index buckets: %v", err)
+	}
+
+	return &Index{db: db}, nil
+}
+
+// Close closes the index
+func (i *Index) Close() error {
+	return i.db.Close()
+}
+
+// hashKey returns the by_hash key of the meta
+func hashKey(m *ImageMeta) []byte {
+	return []byte(m.Hash + ":" + m.ID)
+}
+
+// createdKey returns the by_created key of the meta
+func createdKey(m *ImageMeta) []byte {
+	k := make([]byte, 8, 8+len(m.ID))
+	binary.BigEndian.PutUint64(k, uint64(m.CreatedAt.UnixNano()))
+	return append(k, m.ID...)
+}
+
+// getMeta decodes the meta with given id from the images bucket
+func getMeta(tx *bolt.Tx, id string) (*ImageMeta, error) {
+	d := tx.Bucket(imagesBucket).Get([]byte(id))
+	if d == nil {
+		return nil, ErrImageNotFound
+	}
+
+	var m ImageMeta
+	err := json.Unmarshal(d, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode index entry %s: %v", id, err)
+	}
+
+	return &m, nil
+}
+
+// deleteMeta removes the meta and its secondary keys
+func deleteMeta(tx *bolt.Tx, m *ImageMeta) error {
+	err := tx.Bucket(hashBucket).Delete(hashKey(m))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(createdBucket).Delete(createdKey(m))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(imagesBucket).Delete([]byte(m.ID))
+}
+
+// Put adds the meta to index, replacing any existing entry of the image
+func (i *Index) Put(m *ImageMeta) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode index entry %s: %v", m.ID, err)
+	}
+
+	err = i.db.Update(func(tx *bolt.Tx) error {
+		old, err := getMeta(tx, m.ID)
+		if err == nil {
+			err = deleteMeta(tx, old)
+		}
+
+		if err != nil && err != ErrImageNotFound {
+			return err
+		}
+
+		err = tx.Bucket(imagesBucket).Put([]byte(m.ID), d)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(hashBucket).Put(hashKey(m), nil)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(createdBucket).Put(createdKey(m), nil)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index image %s: %v", m.ID, err)
+	}
+
+	return nil
+}
+
+// Get returns the meta of the image with given id
+func (i *Index) Get(id string) (m *ImageMeta, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		m, err = getMeta(tx, id)
+		return err
+	})
+
+	return m, err
+}
+
+// Delete removes the image with given id from index
+func (i *Index) Delete(id string) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		m, err := getMeta(tx, id)
+		if err != nil {
+			return err
+		}
+
+		return deleteMeta(tx, m)
+	})
+}
+
+// List returns the meta of all the indexed images ordered by creation time
+func (i *Index) List() (ms []*ImageMeta, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(createdBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			m, err := getMeta(tx, string(k[8:]))
+			if err != nil {
+				return err
+			}
+
+			ms = append(ms, m)
+		}
+
+		return nil
+	})
+
+	return ms, err
+}
+
+// FindByHash returns the meta of all the images with given content hash
+func (i *Index) FindByHash(hash string) (ms []*ImageMeta, err error) {
+	prefix := []byte(hash + ":")
+	err = i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(hashBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			m, err := getMeta(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+
+			ms = append(ms, m)
+		}
+
+		return nil
+	})
+
+	return ms, err
+}
+
+// ListQuery filters and orders the images listed from the index
+type ListQuery struct {
+	Format string    // Format: only list images of this format
+	From   time.Time // From: only list images created at or after this time
+	To     time.Time // To: only list images created before this time
+	Sort   string    // Sort: sort field [created|size], defaults to created
+	Desc   bool      // Desc: list in descending order
+	Limit  int       // Limit: maximum number of images to list
+	Cursor string    // Cursor: next cursor returned by the previous listing
+}
+
+// match checks if the meta passes the query filters
+func (q ListQuery) match(m *ImageMeta) bool {
+	if q.Format != "" && m.Format != q.Format {
+		return false
+	}
+
+	if !q.From.IsZero() && m.CreatedAt.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && !m.CreatedAt.Before(q.To) {
+		return false
+	}
+
+	return true
+}
+
+// sizeKey returns the key used to order the meta by size
+func sizeKey(m *ImageMeta) []byte {
+	k := make([]byte, 8, 8+len(m.ID))
+	binary.BigEndian.PutUint64(k, uint64(m.Size))
+	return append(k, m.ID...)
+}
+
+// encodeCursor returns an opaque cursor pointing at the key in the given sort order
+func encodeCursor(sort string, key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte(sort+":"), key...))
+}
+
+// decodeCursor returns the key the cursor points at in the given sort order
+func decodeCursor(sort, c string) ([]byte, error) {
+	d, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil || !strings.HasPrefix(string(d), sort+":") {
+		return nil, fmt.Errorf("invalid cursor: %s", c)
+	}
+
+	return d[len(sort)+1:], nil
+}
+
+// Query lists a page of the images matching the query
+// next is the cursor of the following page, empty when there are no more images
+func (i *Index) Query(q ListQuery) (ms []*ImageMeta, next string, err error) {
+	if q.Sort == "" {
+		q.Sort = "created"
+	}
+
+	if q.Limit <= 0 || q.Limit > maxListLimit {
+		q.Limit = maxListLimit
+	}
+
+	var after []byte
+	if q.Cursor != "" {
+		after, err = decodeCursor(q.Sort, q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var keys [][]byte
+	switch q.Sort {
+	case "created":
+		ms, keys, err = i.queryCreated(q, after)
+	case "size":
+		ms, keys, err = i.querySize(q, after)
+	default:
+		return nil, "", fmt.Errorf("unknown sort field: %s", q.Sort)
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ms) > q.Limit {
+		ms = ms[:q.Limit]
+		next = encodeCursor(q.Sort, keys[q.Limit-1])
+	}
+
+	return ms, next, nil
+}
+
+// queryCreated walks the by_created bucket from the cursor and returns upto limit+1 matching images
+func (i *Index) queryCreated(q ListQuery, after []byte) (ms []*ImageMeta, keys [][]byte, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(createdBucket).Cursor()
+		var k []byte
+		switch {
+		case after == nil && q.Desc:
+			k, _ = c.Last()
+		case after == nil:
+			k, _ = c.First()
+		case q.Desc:
+			k, _ = c.Seek(after)
+			if k == nil {
+				k, _ = c.Last()
+			}
+
+			for k != nil && bytes.Compare(k, after) >= 0 {
+				k, _ = c.Prev()
+			}
+		default:
+			k, _ = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, _ = c.Next()
+			}
+		}
+
+		for ; k != nil && len(ms) <= q.Limit; k = step(c, q.Desc) {
+			m, err := getMeta(tx, string(k[8:]))
+			if err != nil {
+				return err
+			}
+
+			// images are ordered by creation, so nothing past the range can match
+			if q.Desc && !q.From.IsZero() && m.CreatedAt.Before(q.From) ||
+				!q.Desc && !q.To.IsZero() && !m.CreatedAt.Before(q.To) {
+				break
+			}
+
+			if q.match(m) {
+				ms = append(ms, m)
+				keys = append(keys, append([]byte(nil), k...))
+			}
+		}
+
+		return nil
+	})
+
+	return ms, keys, err
+}
+
+// step moves the cursor to the next key in the listing order
+func step(c *bolt.Cursor, desc bool) []byte {
+	var k []byte
+	if desc {
+		k, _ = c.Prev()
+	} else {
+		k, _ = c.Next()
+	}
+
+	return k
+}
+
+// querySize orders all the matching images by size and returns upto limit+1 images after the cursor
+func (i *Index) querySize(q ListQuery, after []byte) (ms []*ImageMeta, keys [][]byte, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, v []byte) error {
+			var m ImageMeta
+			err := json.Unmarshal(v, &m)
+			if err != nil {
+				return fmt.Errorf("failed to decode index entry %s: %v", k, err)
+			}
+
+			if q.match(&m) {
+				ms = append(ms, &m)
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(ms, func(a, b int) bool {
+		c := bytes.Compare(sizeKey(ms[a]), sizeKey(ms[b]))
+		if q.Desc {
+			return c > 0
+		}
+
+		return c < 0
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(ms), func(j int) bool {
+			c := bytes.Compare(sizeKey(ms[j]), after)
+			if q.Desc {
+				return c < 0
+			}
+
+			return c > 0
+		})
+	}
+
+	ms = ms[start:]
+	if len(ms) > q.Limit+1 {
+		ms = ms[:q.Limit+1]
+	}
+
+	for _, m := range ms {
+		keys = append(keys, sizeKey(m))
+	}
+
+	return ms, keys, nil
+}
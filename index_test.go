@@ -0,0 +1,219 @@
+package progimg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempIndex(t *testing.T) (*Index, func()) {
+	dir, err := ioutil.TempDir("", "prog-image-index")
+	if err != nil {
+		t.Fatalf("unexpected error: temp dir: %v", err)
+	}
+
+	idx, err := OpenIndex(filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: open index: %v", err)
+	}
+
+	return idx, func() {
+		idx.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_newImageMeta(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.png"))
+	img := newImage("png", data)
+	m := newImageMeta(img, "file")
+	if m.ID != img.ID || m.Format != "png" || m.Source != "file" || m.Size != int64(len(data)) {
+		t.Fatalf("unexpected error: meta mismatch: %+v", m)
+	}
+
+	if m.Width != 600 || m.Height != 600 {
+		t.Fatalf("unexpected error: dimensions: %dx%d", m.Width, m.Height)
+	}
+
+	if m.Hash != sha256Hex(data) {
+		t.Fatalf("unexpected error: hash: %s", m.Hash)
+	}
+}
+
+func Test_Index(t *testing.T) {
+	idx, done := tempIndex(t)
+	defer done()
+
+	now := time.Now().UTC()
+	tests := []*ImageMeta{
+		{ID: "3", Format: "png", Hash: "aa", CreatedAt: now.Add(2 * time.Second)},
+		{ID: "1", Format: "jpeg", Hash: "bb", CreatedAt: now},
+		{ID: "2", Format: "png", Hash: "aa", CreatedAt: now.Add(time.Second)},
+	}
+
+	for _, m := range tests {
+		err := idx.Put(m)
+		if err != nil {
+			t.Fatalf("unexpected error: put: %v", err)
+		}
+	}
+
+	m, err := idx.Get("1")
+	if err != nil {
+		t.Fatalf("unexpected error: get: %v", err)
+	}
+
+	if !reflect.DeepEqual(m, tests[1]) {
+		t.Fatalf("unexpected error: meta mismatch: %+v", m)
+	}
+
+	ms, err := idx.List()
+	if err != nil {
+		t.Fatalf("unexpected error: list: %v", err)
+	}
+
+	if len(ms) != 3 || ms[0].ID != "1" || ms[1].ID != "2" || ms[2].ID != "3" {
+		t.Fatalf("unexpected error: list order: %v", ms)
+	}
+
+	ms, err = idx.FindByHash("aa")
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("unexpected error: find by hash: %v, %v", ms, err)
+	}
+
+	// replacing an entry must drop its old secondary keys
+	err = idx.Put(&ImageMeta{ID: "2", Format: "png", Hash: "cc", CreatedAt: now})
+	if err != nil {
+		t.Fatalf("unexpected error: put: %v", err)
+	}
+
+	ms, _ = idx.FindByHash("aa")
+	if len(ms) != 1 || ms[0].ID != "3" {
+		t.Fatalf("unexpected error: stale hash entry: %v", ms)
+	}
+
+	ms, _ = idx.List()
+	if len(ms) != 3 {
+		t.Fatalf("unexpected error: stale created entry: %v", ms)
+	}
+
+	err = idx.Delete("2")
+	if err != nil {
+		t.Fatalf("unexpected error: delete: %v", err)
+	}
+
+	if _, err := idx.Get("2"); err != ErrImageNotFound {
+		t.Fatalf("expected not found but got %v", err)
+	}
+
+	if err := idx.Delete("2"); err != ErrImageNotFound {
+		t.Fatalf("expected not found but got %v", err)
+	}
+
+	ms, _ = idx.FindByHash("cc")
+	if len(ms) != 0 {
+		t.Fatalf("unexpected error: stale hash entry: %v", ms)
+	}
+}
+
+func Test_Index_Query(t *testing.T) {
+	idx, done := tempIndex(t)
+	defer done()
+
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		format := "png"
+		if i%2 == 1 {
+			format = "jpeg"
+		}
+
+		err := idx.Put(&ImageMeta{
+			ID:        fmt.Sprint(i),
+			Format:    format,
+			Size:      int64(100 - i%5),
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: put: %v", err)
+		}
+	}
+
+	tests := []struct {
+		q   ListQuery
+		ids []string
+	}{
+		{
+			q:   ListQuery{Limit: 4},
+			ids: []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"},
+		},
+
+		{
+			q:   ListQuery{Limit: 3, Desc: true},
+			ids: []string{"9", "8", "7", "6", "5", "4", "3", "2", "1", "0"},
+		},
+
+		{
+			q:   ListQuery{Limit: 2, Format: "jpeg"},
+			ids: []string{"1", "3", "5", "7", "9"},
+		},
+
+		{
+			q:   ListQuery{Limit: 2, From: now.Add(2 * time.Minute), To: now.Add(6 * time.Minute)},
+			ids: []string{"2", "3", "4", "5"},
+		},
+
+		{
+			q:   ListQuery{Limit: 3, Desc: true, From: now.Add(2 * time.Minute), To: now.Add(6 * time.Minute)},
+			ids: []string{"5", "4", "3", "2"},
+		},
+
+		{
+			q:   ListQuery{Limit: 3, Sort: "size"},
+			ids: []string{"4", "9", "3", "8", "2", "7", "1", "6", "0", "5"},
+		},
+
+		{
+			q:   ListQuery{Limit: 4, Sort: "size", Desc: true, Format: "png"},
+			ids: []string{"0", "6", "2", "8", "4"},
+		},
+	}
+
+	for _, c := range tests {
+		var ids []string
+		for {
+			ms, next, err := idx.Query(c.q)
+			if err != nil {
+				t.Fatalf("unexpected error: query: %v", err)
+			}
+
+			if len(ms) > c.q.Limit {
+				t.Fatalf("unexpected error: page size %d > %d", len(ms), c.q.Limit)
+			}
+
+			for _, m := range ms {
+				ids = append(ids, m.ID)
+			}
+
+			if next == "" {
+				break
+			}
+
+			c.q.Cursor = next
+		}
+
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Fatalf("expected %v but got %v", c.ids, ids)
+		}
+	}
+
+	_, _, err := idx.Query(ListQuery{Sort: "size", Cursor: encodeCursor("created", []byte("1"))})
+	if err == nil || !strings.Contains(err.Error(), "invalid cursor") {
+		t.Fatalf("expected cursor error but got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package progimg
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+)
+
+// metadata strip policies
+const (
+	stripNone    = "none"    // keep all the metadata
+	stripPrivate = "private" // remove the location, the identifying exif tags and xmp
+	stripAll     = "all"     // remove all the metadata
+)
+
+// uploadStrip is the strip policy applied to the uploaded originals
+var uploadStrip = stripNone
+
+// validStrip checks if policy is a known strip policy
+func validStrip(policy string) bool {
+	switch policy {
+	case stripNone, stripPrivate, stripAll:
+		return true
+	}
+
+	return false
+}
+
+// imageMetadata is the embedded metadata of an image
+type imageMetadata struct {
+	ID   string    `json:"id"`             // ID: unique ID for image
+	EXIF *exifInfo `json:"exif,omitempty"` // EXIF: commonly used exif data
+	XMP  string    `json:"xmp,omitempty"`  // XMP: raw xmp packet
+}
+
+// getMetadata returns the embedded metadata of the image
+// malformed exif data is left out
+func getMetadata(img *Image) *imageMetadata {
+	m := &imageMetadata{ID: img.ID, XMP: string(xmpData(img))}
+	if data := exifData(img); data != nil {
+		m.EXIF, _ = parseEXIF(data)
+	}
+
+	return m
+}
+
+// stripMetadata removes the metadata of the image as per policy
+func stripMetadata(img *Image, policy string) error {
+	switch policy {
+	case stripPrivate:
+		return stripPrivateMetadata(img)
+	case stripAll:
+		return stripAllMetadata(img)
+	}
+
+	return nil
+}
+
+// stripPrivateMetadata removes the gps and identifying exif tags in place and drops the
+// xmp packet which can repeat them, everything is removed when the exif is malformed
+func stripPrivateMetadata(img *Image) error {
+	data := append([]byte{}, img.Data...)
+	var err error
+	switch img.Format {
+	case "jpeg":
+		// app13 holds the iptc data which can carry the location as well
+		data, err = filterJPEG(data, func(marker byte, payload []byte) bool {
+			isXMP := bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, xmpExtensionHeader)
+			return marker != 0xed && !(marker == 0xe1 && isXMP)
+		})
+		if err == nil {
+			err = stripPrivateData(jpegEXIF(data))
+		}
+	case "webp":
+		data, err = filterWebP(data, func(fourCC string) bool { return fourCC != "XMP " })
+		if err == nil {
+			err = stripPrivateData(webpEXIF(data))
+		}
+	case "tiff":
+		err = stripPrivateData(data)
+	case "png":
+		data, err = filterPNG(data, func(typ string, chunk []byte) bool {
+			return typ != "eXIf" && !(typ == "iTXt" && bytes.HasPrefix(chunk, pngXMPKeyword))
+		})
+	}
+
+	if err != nil {
+		return stripAllMetadata(img)
+	}
+
+	img.Data = data
+	return nil
+}
+
+// stripPrivateData strips the exif data in place when present
+func stripPrivateData(exif []byte) error {
+	if exif == nil {
+		return nil
+	}
+
+	return stripPrivateEXIF(exif)
+}
+
+// stripAllMetadata removes all the metadata while keeping the colour profile
+// images with an exif orientation are turned upright first
+func stripAllMetadata(img *Image) error {
+	if exifOrientation(img) != 1 {
+		// encoding again drops all the metadata, the colour profile is carried over
+		orig := img.Data
+		err := orientOriginal(img)
+		if err != nil {
+			return err
+		}
+
+		return copyColourProfile(img, orig)
+	}
+
+	var data []byte
+	var err error
+	switch img.Format {
+	case "jpeg":
+		// app0(jfif), app2(icc profile) and app14(adobe colour transform) are kept
+		data, err = filterJPEG(img.Data, func(marker byte, _ []byte) bool {
+			isApp := marker >= 0xe0 && marker <= 0xef
+			return marker != 0xfe && (!isApp || marker == 0xe0 || marker == 0xe2 || marker == 0xee)
+		})
+	case "webp":
+		data, err = filterWebP(img.Data, func(fourCC string) bool {
+			return fourCC != "EXIF" && fourCC != "XMP "
+		})
+	case "png":
+		data, err = filterPNG(img.Data, func(typ string, _ []byte) bool {
+			switch typ {
+			case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+				return false
+			}
+
+			return true
+		})
+	case "gif":
+		// comments and application data other than the loop count are not encoded
+		var g *gif.GIF
+		g, err = decodeGIF(img.Data)
+		if err == nil {
+			var buf bytes.Buffer
+			err = gif.EncodeAll(&buf, g)
+			data = buf.Bytes()
+		}
+	case "tiff":
+		// the tags are dropped by encoding again
+		gimg, derr := getGoImage(img)
+		if derr != nil {
+			return fmt.Errorf("failed to decode image: %v", derr)
+		}
+
+		data, err = encodeImage(gimg, img.Format, nil)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to strip metadata: %v", err)
+	}
+
+	img.Data = data
+	return nil
+}
+
+// iccHeader is the identifier of the jpeg app2 segments holding the icc profile
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// copyColourProfile inserts the icc profile of the original jpeg after the start of the encoded image
+// the profile can span several app2 segments
+func copyColourProfile(img *Image, orig []byte) error {
+	if img.Format != "jpeg" {
+		return nil
+	}
+
+	var profile []byte
+	_, err := walkJPEG(orig, func(marker byte, payload, seg []byte) bool {
+		if marker == 0xe2 && bytes.HasPrefix(payload, iccHeader) {
+			profile = append(profile, seg...)
+		}
+
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read colour profile: %v", err)
+	}
+
+	if profile == nil {
+		return nil
+	}
+
+	img.Data = append(append(append([]byte{}, img.Data[:2]...), profile...), img.Data[2:]...)
+	return nil
+}
+
+// filterJPEG returns the jpeg with only the segments before the image data for which keep returns true
+func filterJPEG(data []byte, keep func(marker byte, payload []byte) bool) ([]byte, error) {
+	var segs []byte
+	sos, err := walkJPEG(data, func(marker byte, payload, seg []byte) bool {
+		if keep(marker, payload) {
+			segs = append(segs, seg...)
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := append(append([]byte{}, data[:2]...), segs...)
+	return append(out, data[sos:]...), nil
+}
+
+// filterWebP returns the webp with only the chunks for which keep returns true
+// the metadata flags of the extended header are updated to match
+func filterWebP(data []byte, keep func(fourCC string) bool) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []webpChunk
+	var flags byte
+	for _, c := range chunks {
+		if !keep(c.fourCC) {
+			continue
+		}
+
+		switch c.fourCC {
+		case "EXIF":
+			flags |= 1 << 3
+		case "XMP ":
+			flags |= 1 << 2
+		}
+
+		kept = append(kept, c)
+	}
+
+	for i, c := range kept {
+		if c.fourCC == "VP8X" && len(c.data) > 0 {
+			vp8x := append([]byte{}, c.data...)
+			vp8x[0] = vp8x[0]&^(1<<3|1<<2) | flags
+			kept[i].data = vp8x
+		}
+	}
+
+	var buf bytes.Buffer
+	err = writeWebP(&buf, kept...)
+	return buf.Bytes(), err
+}
+
+// filterPNG returns the png with only the chunks for which keep returns true
+func filterPNG(data []byte, keep func(typ string, chunk []byte) bool) ([]byte, error) {
+	var out []byte
+	err := walkPNG(data, func(typ string, chunk, raw []byte) bool {
+		if keep(typ, chunk) {
+			out = append(out, raw...)
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, pngSignature...), out...), nil
+}
@@ -0,0 +1,204 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"testing"
+)
+
+// pngChunk returns a png chunk with its length and crc
+func pngChunk(typ string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	b = append(b, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc...)
+}
+
+// withJPEGSegment inserts a segment after the start of the jpeg
+func withJPEGSegment(data []byte, marker byte, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	buf.Write([]byte{0xff, marker})
+	binary.Write(&buf, binary.BigEndian, uint16(len(payload)+2))
+	buf.Write(payload)
+	buf.Write(data[2:])
+	return buf.Bytes()
+}
+
+// testMetadataImages returns images of each format with exif and xmp metadata where supported
+func testMetadataImages(t *testing.T) []*Image {
+	exif := testCameraEXIF(binary.LittleEndian)
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><exif:GPSLatitude>12,30N</exif:GPSLatitude></x:xmpmeta>`)
+	encode := func(format string) []byte {
+		data, err := encodeImage(testImage(20, 10), format, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: encode %s: %v", format, err)
+		}
+
+		return data
+	}
+
+	jpg := withJPEGEXIF(encode("jpeg"), exif)
+	jpg = withJPEGSegment(jpg, 0xe1, append(append([]byte{}, xmpHeader...), xmp...))
+	jpg = withJPEGSegment(jpg, 0xfe, []byte("a comment"))
+
+	// the lossy transparent webp carries an extended header
+	var webpBuf bytes.Buffer
+	err := encodeWebP(&webpBuf, testPhoto(20, 10, true), 75, false)
+	if err != nil {
+		t.Fatalf("unexpected error: encode webp: %v", err)
+	}
+
+	chunks, err := webpChunks(webpBuf.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: webp chunks: %v", err)
+	}
+
+	chunks[0].data[0] |= 1<<3 | 1<<2
+	chunks = append(chunks, webpChunk{"EXIF", exif}, webpChunk{"XMP ", xmp})
+	webpBuf.Reset()
+	writeWebP(&webpBuf, chunks...)
+
+	png := encode("png")
+	png = append(png[:33:33], append(pngChunk("iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmp...)),
+		append(pngChunk("tEXt", []byte("Author\x00someone")), png[33:]...)...)...)
+
+	return []*Image{
+		newImage("jpeg", jpg),
+		newImage("webp", webpBuf.Bytes()),
+		newImage("png", png),
+	}
+}
+
+func Test_getMetadata(t *testing.T) {
+	for _, img := range testMetadataImages(t) {
+		m := getMetadata(img)
+		if m.XMP == "" {
+			t.Fatalf("%s: expected xmp", img.Format)
+		}
+
+		if img.Format == "png" {
+			continue
+		}
+
+		if m.EXIF == nil || m.EXIF.Model != "Canon EOS 5D" || m.EXIF.GPS == nil {
+			t.Fatalf("%s: unexpected exif: %+v", img.Format, m.EXIF)
+		}
+	}
+}
+
+func Test_stripMetadata(t *testing.T) {
+	for _, policy := range []string{stripPrivate, stripAll} {
+		for _, img := range testMetadataImages(t) {
+			src, err := getGoImage(img)
+			if err != nil {
+				t.Fatalf("unexpected error: decode %s: %v", img.Format, err)
+			}
+
+			err = stripMetadata(img, policy)
+			if err != nil {
+				t.Fatalf("unexpected error: %s %s: %v", policy, img.Format, err)
+			}
+
+			gimg, err := getGoImage(img)
+			if err != nil || gimg.Bounds() != src.Bounds() {
+				t.Fatalf("%s %s: unexpected image: %v", policy, img.Format, err)
+			}
+
+			m := getMetadata(img)
+			if m.XMP != "" || bytes.Contains(img.Data, []byte("SN1234567")) {
+				t.Fatalf("%s %s: expected private metadata to be removed", policy, img.Format)
+			}
+
+			switch {
+			case policy == stripAll && m.EXIF != nil:
+				t.Fatalf("%s %s: expected exif to be removed: %+v", policy, img.Format, m.EXIF)
+			case policy == stripPrivate && img.Format != "png" && (m.EXIF == nil || m.EXIF.GPS != nil || m.EXIF.Make != "Canon"):
+				t.Fatalf("%s %s: expected only the location to be removed: %+v", policy, img.Format, m.EXIF)
+			}
+
+			if policy == stripAll && (bytes.Contains(img.Data, []byte("a comment")) || bytes.Contains(img.Data, []byte("someone"))) {
+				t.Fatalf("%s %s: expected comments to be removed", policy, img.Format)
+			}
+		}
+	}
+}
+
+func Test_stripMetadata_lossyWebP(t *testing.T) {
+	lossy, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.webp"))
+	img := newImage("webp", withWebPEXIF(t, lossy, testEXIF(binary.BigEndian, 6)))
+	err := stripMetadata(img, stripAll)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// lossy webp is turned upright and encoded lossy again
+	gimg, err := getGoImage(img)
+	if err != nil || !lossyWebP(img) || exifOrientation(img) != 1 || gimg.Bounds() != image.Rect(0, 0, 100, 150) {
+		t.Fatalf("unexpected error: expected an oriented lossy webp: %v", err)
+	}
+}
+
+func Test_stripMetadata_tiffXMP(t *testing.T) {
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><exif:GPSLatitude>12,30N</exif:GPSLatitude></x:xmpmeta>`
+	img := newImage("tiff", buildEXIF(binary.LittleEndian,
+		[]testTag{
+			{tagMake, "Canon"},
+			{tagXMP, xmp},
+			{tagIPTC, "iptc city"},
+		}, nil, nil))
+	if getMetadata(img).XMP == "" {
+		t.Fatalf("expected xmp before strip")
+	}
+
+	err := stripMetadata(img, stripPrivate)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := getMetadata(img)
+	if m.XMP != "" || bytes.Contains(img.Data, []byte("iptc city")) {
+		t.Fatalf("expected the xmp and iptc tags to be removed")
+	}
+
+	if m.EXIF == nil || m.EXIF.Make != "Canon" {
+		t.Fatalf("expected the camera tags to be kept: %+v", m.EXIF)
+	}
+}
+
+func Test_stripMetadata_orientedICC(t *testing.T) {
+	jpg, err := encodeImage(testImage(20, 10), "jpeg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	icc := append(append([]byte{}, iccHeader...), "\x01\x01profile data"...)
+	img := newImage("jpeg", withJPEGSegment(withJPEGEXIF(jpg, testEXIF(binary.BigEndian, 6)), 0xe2, icc))
+	err = stripMetadata(img, stripAll)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gimg, err := getGoImage(img)
+	if err != nil || exifOrientation(img) != 1 || gimg.Bounds() != image.Rect(0, 0, 10, 20) {
+		t.Fatalf("unexpected error: expected an oriented jpeg: %v", err)
+	}
+
+	var got []byte
+	walkJPEG(img.Data, func(marker byte, payload, _ []byte) bool {
+		if marker == 0xe2 {
+			got = payload
+		}
+
+		return true
+	})
+	if !bytes.Equal(got, icc) {
+		t.Fatalf("expected the icc profile to be kept but got %q", got)
+	}
+}
@@ -0,0 +1,121 @@
+package progimg
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// autoFormat is the format that picks the output format from the accept header
+const autoFormat = "auto"
+
+// fallbackFormats are tried in order when the stored format isn't accepted
+var fallbackFormats = []string{"jpeg", "png"}
+
+// losslessFormats are the stored formats that lossy webp is smaller than
+// lossy sources only lose more detail and may grow when encoded again
+var losslessFormats = map[string]bool{"png": true, "bmp": true, "tiff": true}
+
+// acceptedFormats holds the quality of the image formats in an accept header
+// "*" holds the quality of image/* and */*
+type acceptedFormats map[string]float64
+
+// parseAccept parses the image formats of the accept header
+// malformed media ranges are ignored
+func parseAccept(accept string) acceptedFormats {
+	af := acceptedFormats{}
+	for _, r := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		switch {
+		case mt == "*/*" || mt == "image/*":
+			if q > af["*"] {
+				af["*"] = q
+			}
+		case strings.HasPrefix(mt, "image/"):
+			af[strings.TrimPrefix(mt, "image/")] = q
+		}
+	}
+
+	return af
+}
+
+// accepts checks if the format is accepted either by name or by a wildcard
+func (af acceptedFormats) accepts(format string) bool {
+	if q, ok := af[format]; ok {
+		return q > 0
+	}
+
+	return af["*"] > 0
+}
+
+// explicit checks if the format is accepted by name
+// wildcards don't count as clients without webp support send them as well
+func (af acceptedFormats) explicit(format string) bool {
+	return af[format] > 0
+}
+
+// negotiateFormat picks the output format for the accept header
+// webp is preferred for the lossless formats when explicitly accepted, then the stored format, then jpeg and png
+// accepted gifs are kept as they may be animated and only gif keeps the frames
+// an empty format is returned to keep the stored format
+func negotiateFormat(accept string, stored func() (string, error)) (string, error) {
+	af := parseAccept(accept)
+	if len(af) == 0 {
+		return "", nil
+	}
+
+	format, err := stored()
+	if err != nil {
+		return "", err
+	}
+
+	if format == "gif" && af.accepts(format) {
+		return "", nil
+	}
+
+	if af.explicit("webp") && (losslessFormats[format] || !af.accepts(format)) {
+		return "webp", nil
+	}
+
+	if af.accepts(format) {
+		return "", nil
+	}
+
+	for _, f := range fallbackFormats {
+		if af.explicit(f) {
+			return f, nil
+		}
+	}
+
+	return "", nil
+}
+
+// storedFormat returns the format of the stored image with given id
+// the index is used when possible and the store's stat otherwise to avoid fetching the image
+func storedFormat(id string) (string, error) {
+	if imageIndex != nil {
+		m, err := imageIndex.Get(id)
+		if err == nil {
+			return m.Format, nil
+		}
+	}
+
+	st, err := imageStore.Stat(id)
+	if err != nil {
+		return "", err
+	}
+
+	return st.Format, nil
+}
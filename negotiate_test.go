@@ -0,0 +1,106 @@
+package progimg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_negotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		stored string
+		format string
+	}{
+		{
+			accept: "image/avif,image/webp,image/apng,image/*,*/*;q=0.8",
+			stored: "png",
+			format: "webp",
+		},
+
+		{
+			accept: "image/webp;q=0,image/*",
+			stored: "jpeg",
+			format: "",
+		},
+
+		{
+			accept: "image/avif,image/webp,image/apng,image/*,*/*;q=0.8",
+			stored: "jpeg",
+			format: "",
+		},
+
+		{
+			accept: "image/webp",
+			stored: "jpeg",
+			format: "webp",
+		},
+
+		{
+			accept: "image/webp,image/*",
+			stored: "tiff",
+			format: "webp",
+		},
+
+		{
+			accept: "image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5",
+			stored: "jpeg",
+			format: "",
+		},
+
+		{
+			accept: "image/png,image/jpeg",
+			stored: "webp",
+			format: "jpeg",
+		},
+
+		{
+			accept: "image/png, image/webp;q=0",
+			stored: "webp",
+			format: "png",
+		},
+
+		{
+			accept: "image/gif",
+			stored: "webp",
+			format: "",
+		},
+
+		{
+			accept: "image/webp,image/*",
+			stored: "gif",
+			format: "",
+		},
+
+		{
+			accept: "image/webp,image/png",
+			stored: "gif",
+			format: "webp",
+		},
+
+		{
+			accept: "",
+			stored: "webp",
+			format: "",
+		},
+	}
+
+	for _, c := range tests {
+		format, err := negotiateFormat(c.accept, func() (string, error) {
+			return c.stored, nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if format != c.format {
+			t.Fatalf("expected %q but got %q for %s", c.format, format, c.accept)
+		}
+	}
+
+	_, err := negotiateFormat("image/png", func() (string, error) {
+		return "", fmt.Errorf("image not found")
+	})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
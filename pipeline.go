@@ -0,0 +1,807 @@
+package progimg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxOperations is the maximum number of operations in a pipeline
+const maxOperations = 16
+
+// maxFrame is the largest frame number that can be extracted from an animation
+const maxFrame = 1 << 16
+
+// operation is a single step of the transform pipeline
+type operation interface {
+	// apply runs the operation on the image and returns the result
+	// bg is the colour for the alpha removed by the operation
+	apply(src image.Image, bg color.Color) (image.Image, error)
+
+	// String returns the canonical form of the operation as used in the url path
+	String() string
+}
+
+// dependent is implemented by the operations that read other stored images
+type dependent interface {
+	// deps returns the ids of the stored images read by the operation
+	deps() []string
+}
+
+// opParser parses the colon separated arguments of an operation in the url path
+type opParser func(args []string) (operation, error)
+
+// opParsers acts a mux for the operations in the url path
+var opParsers map[string]opParser
+
+// pipeline is an ordered list of operations run on the decoded image
+// followed by encoding to the output format
+type pipeline struct {
+	ops    []operation
+	format string // format: output format, defaults to image format
+	frame  int    // frame: frame of an animation to transform counting from 1, 0 keeps all frames
+	strip  bool   // strip: remove the metadata of an image that is not encoded again
+	opts   encodeOptions
+}
+
+// String returns the canonical form of the pipeline as used in the url path
+func (p *pipeline) String() string {
+	var segs []string
+	if p.frame > 0 {
+		segs = append(segs, fmt.Sprintf("frame:%d", p.frame))
+	}
+
+	for _, op := range p.ops {
+		segs = append(segs, op.String())
+	}
+
+	if p.format != "" {
+		segs = append(segs, "format:"+p.format)
+	}
+
+	if p.opts.quality > 0 {
+		segs = append(segs, fmt.Sprintf("quality:%d", p.opts.quality))
+	}
+
+	if p.opts.lossless {
+		segs = append(segs, "lossless")
+	}
+
+	if p.opts.compression != "" {
+		segs = append(segs, "compression:"+p.opts.compression)
+	}
+
+	if p.opts.background != nil {
+		c := p.opts.background
+		segs = append(segs, fmt.Sprintf("bg:%02x%02x%02x", c.R, c.G, c.B))
+	}
+
+	if p.strip {
+		segs = append(segs, "strip")
+	}
+
+	return strings.Join(segs, "/")
+}
+
+// cacheKey returns the key of the derivatives of the pipeline
+// the key carries the effective encoder settings as the server defaults can change
+// between restarts of the disk cache, and the etags of the stored images read by
+// the operations so derivatives are not served once they change or are deleted
+func (p *pipeline) cacheKey() (string, error) {
+	e := p.opts.effective()
+	bg := e.background
+	key := fmt.Sprintf("%s#quality:%d/compression:%s/bg:%02x%02x%02x",
+		p.String(), e.quality, e.compression, bg.R, bg.G, bg.B)
+	for _, op := range p.ops {
+		d, ok := op.(dependent)
+		if !ok {
+			continue
+		}
+
+		for _, id := range d.deps() {
+			st, err := imageStore.Stat(id)
+			if err == ErrImageNotFound {
+				return "", transformError{fmt.Errorf("failed to %s: image %s not found", op, id)}
+			}
+
+			if err != nil {
+				return "", err
+			}
+
+			key += fmt.Sprintf("@%s:%s", id, st.ETag)
+		}
+	}
+
+	return key, nil
+}
+
+// add appends the operation to the pipeline
+func (p *pipeline) add(op operation) error {
+	if len(p.ops) >= maxOperations {
+		return fmt.Errorf("too many operations, maximum is %d", maxOperations)
+	}
+
+	p.ops = append(p.ops, op)
+	return nil
+}
+
+// parsePathPipeline parses the pipeline from the url path
+// eg: frame:2/resize:400x300/crop:200,200:north/format:webp/quality:80
+func parsePathPipeline(path string) (*pipeline, error) {
+	p := &pipeline{}
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "" {
+			continue
+		}
+
+		parts := strings.Split(seg, ":")
+		name, args := parts[0], parts[1:]
+		if name == "format" {
+			if len(args) != 1 || args[0] == "" {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			if p.format != "" {
+				return nil, fmt.Errorf("format can only be given once")
+			}
+
+			p.format = args[0]
+			continue
+		}
+
+		if name == "quality" {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			if p.opts.quality != 0 {
+				return nil, fmt.Errorf("quality can only be given once")
+			}
+
+			var err error
+			p.opts.quality, err = parseQuality(args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if name == "bg" {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			if p.opts.background != nil {
+				return nil, fmt.Errorf("bg can only be given once")
+			}
+
+			c, err := parseColor(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid bg: %v", err)
+			}
+
+			p.opts.background = &c
+			continue
+		}
+
+		if name == "compression" {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			if p.opts.compression != "" {
+				return nil, fmt.Errorf("compression can only be given once")
+			}
+
+			var err error
+			p.opts.compression, err = parseCompression(args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if name == "strip" {
+			if len(args) != 0 {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			p.strip = true
+			continue
+		}
+
+		if name == "lossless" {
+			if len(args) != 0 {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			p.opts.lossless = true
+			continue
+		}
+
+		if name == "frame" {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("invalid operation: %s", seg)
+			}
+
+			if p.frame != 0 {
+				return nil, fmt.Errorf("frame can only be given once")
+			}
+
+			var err error
+			p.frame, err = parseDim(args[0], maxFrame)
+			if err != nil {
+				return nil, fmt.Errorf("invalid frame: %v", err)
+			}
+
+			continue
+		}
+
+		parser, ok := opParsers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation: %s", name)
+		}
+
+		op, err := parser(args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operation %s: %v", seg, err)
+		}
+
+		err = p.add(op)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// parseQueryPipeline parses the pipeline from the download query
+// rotate and flip are applied first, then crop, resize, the filters in filterOrder, the text and the watermark
+func parseQueryPipeline(q url.Values) (*pipeline, error) {
+	p := &pipeline{format: q.Get("format")}
+	gravity := q.Get("gravity")
+	if gravity == "" {
+		gravity = "center"
+	}
+
+	if _, ok := gravities[gravity]; !ok {
+		return nil, fmt.Errorf("unknown gravity: %s", gravity)
+	}
+
+	if v := q.Get("quality"); v != "" {
+		var err error
+		p.opts.quality, err = parseQuality(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := q.Get("bg"); v != "" {
+		c, err := parseColor(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bg: %v", err)
+		}
+
+		p.opts.background = &c
+	}
+
+	if v := q.Get("compression"); v != "" {
+		var err error
+		p.opts.compression, err = parseCompression(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := q.Get("lossless"); v != "" {
+		var err error
+		p.opts.lossless, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lossless: %s", v)
+		}
+	}
+
+	if v := q.Get("strip"); v != "" {
+		var err error
+		p.strip, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid strip: %s", v)
+		}
+	}
+
+	if f := q.Get("frame"); f != "" {
+		var err error
+		p.frame, err = parseDim(f, maxFrame)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame: %v", err)
+		}
+	}
+
+	if v := q.Get("rotate"); v != "" {
+		op, err := parseRotateOp(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotate %s: %v", v, err)
+		}
+
+		p.add(op)
+	}
+
+	if v := q.Get("flip"); v != "" {
+		op, err := parseFlipOp(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flip %s: %v", v, err)
+		}
+
+		p.add(op)
+	}
+
+	if c := q.Get("crop"); c == smartCrop {
+		// the aspect ratio is taken from the size the crop is resized to
+		w, werr := parseDim(q.Get("w"), maxDimension)
+		h, herr := parseDim(q.Get("h"), maxDimension)
+		if werr != nil || herr != nil {
+			return nil, fmt.Errorf("invalid crop smart: w and h are required")
+		}
+
+		p.add(newSmartCropOp(w, h))
+	} else if c != "" {
+		op, err := parseCropOp(strings.Split(c, ","), gravity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crop %s: %v", c, err)
+		}
+
+		p.add(op)
+	}
+
+	op := &resizeOp{gravity: gravity}
+	for k, v := range map[string]*int{"w": &op.width, "h": &op.height} {
+		d := q.Get(k)
+		if d == "" {
+			continue
+		}
+
+		var err error
+		*v, err = parseDim(d, maxDimension)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", k, err)
+		}
+	}
+
+	op.fit = q.Get("fit")
+	if op.fit == "" {
+		op.fit = fitInside
+	}
+
+	if !validFit(op.fit) {
+		return nil, fmt.Errorf("unknown fit: %s", op.fit)
+	}
+
+	if op.width > 0 || op.height > 0 {
+		p.add(op)
+	}
+
+	for _, name := range filterOrder {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+
+		op, err := parseFilterQuery(name, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %v", name, v, err)
+		}
+
+		if op != nil {
+			p.add(op)
+		}
+	}
+
+	if v := q.Get("text"); v != "" {
+		op, err := parseTextOp(textArgs{
+			text:     v,
+			font:     q.Get("text_font"),
+			size:     q.Get("text_size"),
+			color:    q.Get("text_color"),
+			position: q.Get("text_position"),
+			margin:   q.Get("text_margin"),
+			stroke:   q.Get("text_stroke"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid text: %v", err)
+		}
+
+		p.add(op)
+	}
+
+	if id := q.Get("watermark"); id != "" {
+		op, err := parseWatermarkOp(id, q.Get("watermark_position"), q.Get("watermark_margin"),
+			q.Get("watermark_opacity"), q.Get("watermark_scale"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid watermark: %v", err)
+		}
+
+		p.add(op)
+	}
+
+	return p, nil
+}
+
+// parseDim parses a dimension between 1 and max
+func parseDim(d string, max int) (int, error) {
+	v, err := strconv.Atoi(d)
+	if err != nil || v < 1 || v > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d", d, max)
+	}
+
+	return v, nil
+}
+
+// parseQuality parses a quality between 1 and 100 bounded as per the server settings
+func parseQuality(v string) (int, error) {
+	q, err := parseDim(v, 100)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quality: %v", err)
+	}
+
+	return clampQuality(q), nil
+}
+
+// parseCompression parses a png compression
+func parseCompression(v string) (string, error) {
+	if _, ok := pngCompressions[v]; !ok {
+		return "", fmt.Errorf("unknown compression: %s", v)
+	}
+
+	return v, nil
+}
+
+// validFit checks if fit is a known resize fit
+func validFit(fit string) bool {
+	switch fit {
+	case fitInside, fitContain, fitCover, fitFill:
+		return true
+	}
+
+	return false
+}
+
+// transformError is returned when the pipeline can't be run on the image
+type transformError struct {
+	error
+}
+
+// apply runs the operations of the pipeline on the decoded image
+func (p *pipeline) apply(gimg image.Image) (image.Image, error) {
+	var err error
+	for _, op := range p.ops {
+		gimg, err = op.apply(gimg, p.opts.bg())
+		if err != nil {
+			return nil, transformError{fmt.Errorf("failed to %s: %v", op, err)}
+		}
+	}
+
+	return gimg, nil
+}
+
+// transformImage will run the pipeline on the image
+// gifs keep all their frames when converted to gif unless a frame is selected
+// encoded images carry no metadata, strip only affects the images left as they are
+func transformImage(img *Image, p *pipeline) error {
+	rct := p.format
+	if rct == "" {
+		rct = img.Format
+	}
+
+	if rct == img.Format && len(p.ops) == 0 && p.frame == 0 && p.opts == (encodeOptions{}) {
+		if p.strip {
+			err := stripMetadata(img, stripAll)
+			if err != nil {
+				return transformError{err}
+			}
+		}
+
+		return nil
+	}
+
+	if img.Format == "gif" && rct == "gif" && p.frame == 0 {
+		return transformAnimation(img, p)
+	}
+
+	var gimg image.Image
+	var err error
+	switch {
+	case img.Format == "gif" && p.frame > 0:
+		gimg, err = decodeGIFFrame(img.Data, p.frame)
+	case p.frame > 1:
+		err = fmt.Errorf("frame %d is out of range, image has a single frame", p.frame)
+	default:
+		gimg, err = getGoImage(img)
+	}
+
+	if err != nil {
+		return transformError{fmt.Errorf("failed to decode image: %v", err)}
+	}
+
+	gimg, err = p.apply(gimg)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeImage(gimg, rct, &p.opts)
+	if err != nil {
+		return transformError{fmt.Errorf("failed to convert image: %v", err)}
+	}
+
+	img.Format = rct
+	img.Data = data
+	return nil
+}
+
+// resizeOp resizes the image as per fit
+type resizeOp struct {
+	width   int    // width: 0 to derive from height
+	height  int    // height: 0 to derive from width
+	fit     string // fit: how the image fits into width x height
+	gravity string // gravity: region kept by cover fit
+}
+
+// parseResizeOp parses resize:[w]x[h][:fit][:gravity]
+func parseResizeOp(args []string) (operation, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, fmt.Errorf("expected [w]x[h][:fit][:gravity]")
+	}
+
+	op := &resizeOp{fit: fitInside, gravity: "center"}
+	dims := strings.Split(args[0], "x")
+	if len(dims) != 2 || dims[0] == "" && dims[1] == "" {
+		return nil, fmt.Errorf("invalid size: %s", args[0])
+	}
+
+	for i, v := range []*int{&op.width, &op.height} {
+		if dims[i] == "" {
+			continue
+		}
+
+		var err error
+		*v, err = parseDim(dims[i], maxDimension)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) > 1 {
+		op.fit = args[1]
+		if !validFit(op.fit) {
+			return nil, fmt.Errorf("unknown fit: %s", op.fit)
+		}
+	}
+
+	if len(args) > 2 {
+		op.gravity = args[2]
+		if _, ok := gravities[op.gravity]; !ok {
+			return nil, fmt.Errorf("unknown gravity: %s", op.gravity)
+		}
+	}
+
+	return op, nil
+}
+
+func (op *resizeOp) apply(src image.Image, bg color.Color) (image.Image, error) {
+	return resizeImage(src, op.width, op.height, op.fit, op.gravity, bg), nil
+}
+
+func (op *resizeOp) String() string {
+	dim := func(d int) string {
+		if d == 0 {
+			return ""
+		}
+
+		return strconv.Itoa(d)
+	}
+
+	return fmt.Sprintf("resize:%sx%s:%s:%s", dim(op.width), dim(op.height), op.fit, op.gravity)
+}
+
+// cropOp crops the image to an explicit rectangle, a region placed by gravity
+// or the largest region of an aspect ratio picked by its content
+type cropOp struct {
+	rect    image.Rectangle // rect: explicit crop relative to image origin
+	size    image.Point     // size: size of the gravity crop or aspect ratio of the smart crop when rect is empty
+	gravity string          // gravity: placement of the gravity crop
+	smart   bool            // smart: pick the region by its edges, skin tones and entropy
+}
+
+// newSmartCropOp returns the smart crop of aspect ratio w:h
+func newSmartCropOp(w, h int) *cropOp {
+	g := w
+	for r := h; r != 0; {
+		g, r = r, g%r
+	}
+
+	return &cropOp{size: image.Pt(w/g, h/g), smart: true}
+}
+
+// parseCropOp parses x,y,w,h or w,h crop dimensions
+func parseCropOp(dims []string, gravity string) (*cropOp, error) {
+	var d []int
+	for i, p := range dims {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		// x and y can be 0, width and height can't
+		if err != nil || v < 0 || v == 0 && i >= len(dims)-2 || v > maxCropDimension {
+			return nil, fmt.Errorf("invalid crop dimension: %s", p)
+		}
+
+		d = append(d, v)
+	}
+
+	op := &cropOp{gravity: gravity}
+	switch len(d) {
+	case 4:
+		op.rect = image.Rect(d[0], d[1], d[0]+d[2], d[1]+d[3])
+	case 2:
+		op.size = image.Pt(d[0], d[1])
+	default:
+		return nil, fmt.Errorf("expected x,y,w,h or w,h")
+	}
+
+	return op, nil
+}
+
+// parseCropPathOp parses crop:x,y,w,h, crop:w,h[:gravity] or crop:smart:w,h
+func parseCropPathOp(args []string) (operation, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("expected x,y,w,h, w,h[:gravity] or smart:w,h")
+	}
+
+	if args[0] == smartCrop {
+		var ratio []string
+		if len(args) == 2 {
+			ratio = strings.Split(args[1], ",")
+		}
+
+		if len(ratio) != 2 {
+			return nil, fmt.Errorf("expected smart:w,h")
+		}
+
+		var d [2]int
+		for i := range d {
+			var err error
+			d[i], err = parseDim(ratio[i], maxCropDimension)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return newSmartCropOp(d[0], d[1]), nil
+	}
+
+	gravity := "center"
+	if len(args) == 2 {
+		gravity = args[1]
+		if _, ok := gravities[gravity]; !ok {
+			return nil, fmt.Errorf("unknown gravity: %s", gravity)
+		}
+	}
+
+	return parseCropOp(strings.Split(args[0], ","), gravity)
+}
+
+func (op *cropOp) apply(src image.Image, _ color.Color) (image.Image, error) {
+	if op.smart {
+		return cropImage(src, smartCropRect(src, op.size), image.Point{}, "")
+	}
+
+	return cropImage(src, op.rect, op.size, op.gravity)
+}
+
+func (op *cropOp) String() string {
+	if op.smart {
+		return fmt.Sprintf("crop:smart:%d,%d", op.size.X, op.size.Y)
+	}
+
+	if !op.rect.Empty() {
+		r := op.rect
+		return fmt.Sprintf("crop:%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+	}
+
+	return fmt.Sprintf("crop:%d,%d:%s", op.size.X, op.size.Y, op.gravity)
+}
+
+// rotateOp rotates the image clockwise
+type rotateOp struct {
+	angle float64 // angle: degrees in [0, 360)
+}
+
+// parseRotateOp parses the clockwise angle in degrees, eg: 90 or -12.5
+func parseRotateOp(angle string) (*rotateOp, error) {
+	a, err := strconv.ParseFloat(angle, 64)
+	if err != nil || math.IsInf(a, 0) || math.IsNaN(a) {
+		return nil, fmt.Errorf("invalid angle: %s", angle)
+	}
+
+	a = math.Mod(a, 360)
+	if a < 0 {
+		a += 360
+	}
+
+	return &rotateOp{angle: a}, nil
+}
+
+// parseRotatePathOp parses rotate:angle
+func parseRotatePathOp(args []string) (operation, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected angle")
+	}
+
+	return parseRotateOp(args[0])
+}
+
+func (op *rotateOp) apply(src image.Image, bg color.Color) (image.Image, error) {
+	return rotateImage(src, op.angle, bg)
+}
+
+func (op *rotateOp) String() string {
+	return "rotate:" + strconv.FormatFloat(op.angle, 'f', -1, 64)
+}
+
+// flip directions
+const (
+	flipHorizontal = "h" // mirror left to right
+	flipVertical   = "v" // mirror top to bottom
+)
+
+// flipOp mirrors the image
+type flipOp struct {
+	dir string // dir: flipHorizontal or flipVertical
+}
+
+// parseFlipOp parses the flip direction
+func parseFlipOp(dir string) (*flipOp, error) {
+	if dir != flipHorizontal && dir != flipVertical {
+		return nil, fmt.Errorf("unknown flip: %s", dir)
+	}
+
+	return &flipOp{dir: dir}, nil
+}
+
+// parseFlipPathOp parses flip:[h|v]
+func parseFlipPathOp(args []string) (operation, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected h or v")
+	}
+
+	return parseFlipOp(args[0])
+}
+
+func (op *flipOp) apply(src image.Image, _ color.Color) (image.Image, error) {
+	// same as the mirrored exif orientations
+	if op.dir == flipHorizontal {
+		return orientImage(src, 2), nil
+	}
+
+	return orientImage(src, 4), nil
+}
+
+func (op *flipOp) String() string {
+	return "flip:" + op.dir
+}
+
+func init() {
+	opParsers = make(map[string]opParser)
+	opParsers["resize"] = parseResizeOp
+	opParsers["crop"] = parseCropPathOp
+	opParsers["rotate"] = parseRotatePathOp
+	opParsers["flip"] = parseFlipPathOp
+	opParsers["watermark"] = parseWatermarkPathOp
+	opParsers["text"] = parseTextPathOp
+	for name := range filters {
+		opParsers[name] = filterPathParser(name)
+	}
+}
@@ -0,0 +1,515 @@
+package progimg
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_parseQueryPipeline(t *testing.T) {
+	tests := []struct {
+		q   string
+		p   string
+		err string
+	}{
+		{
+			q: "",
+			p: "",
+		},
+
+		{
+			q: "format=jpeg&w=100&h=50&fit=cover",
+			p: "resize:100x50:cover:center/format:jpeg",
+		},
+
+		{
+			q: "crop=10,20,30,40&w=10",
+			p: "crop:10,20,30,40/resize:10x:inside:center",
+		},
+
+		{
+			q: "crop=30,40&gravity=southeast",
+			p: "crop:30,40:southeast",
+		},
+
+		{
+			q:   "w=0",
+			err: "invalid w: 0 must be between 1 and 8192",
+		},
+
+		{
+			q:   "h=abc",
+			err: "invalid h: abc",
+		},
+
+		{
+			q:   "w=10000",
+			err: "invalid w: 10000",
+		},
+
+		{
+			q:   "w=10&fit=stretch",
+			err: "unknown fit: stretch",
+		},
+
+		{
+			q:   "crop=10,20,0,40",
+			err: "invalid crop 10,20,0,40",
+		},
+
+		{
+			q:   "crop=10,20,30",
+			err: "invalid crop 10,20,30",
+		},
+
+		{
+			q:   "crop=10,a",
+			err: "invalid crop 10,a",
+		},
+
+		{
+			q:   "gravity=up",
+			err: "unknown gravity: up",
+		},
+
+		{
+			q: "format=webp&quality=80&lossless=true",
+			p: "format:webp/quality:80/lossless",
+		},
+
+		{
+			q:   "quality=101",
+			err: "invalid quality: 101",
+		},
+
+		{
+			q:   "lossless=yes",
+			err: "invalid lossless: yes",
+		},
+
+		{
+			q: "format=png&compression=best",
+			p: "format:png/compression:best",
+		},
+
+		{
+			q:   "compression=max",
+			err: "unknown compression: max",
+		},
+
+		{
+			q: "w=10&h=10&fit=contain&bg=FF8000",
+			p: "resize:10x10:contain:center/bg:ff8000",
+		},
+
+		{
+			q: "rotate=-90&flip=h&w=10",
+			p: "rotate:270/flip:h/resize:10x:inside:center",
+		},
+
+		{
+			q:   "rotate=left",
+			err: "invalid rotate left",
+		},
+
+		{
+			q:   "flip=x",
+			err: "invalid flip x: unknown flip: x",
+		},
+
+		{
+			q: "sepia=true&w=10&blur=1.5&grayscale=false&sharpen=1,0.5",
+			p: "resize:10x:inside:center/blur:1.5/sharpen:1:0.5/sepia",
+		},
+
+		{
+			q:   "contrast=200",
+			err: "invalid contrast 200: 200 must be between -100 and 100",
+		},
+
+		{
+			q: "watermark=42&watermark_opacity=50&blur=2",
+			p: "blur:2/watermark:42:southeast:0:50:0",
+		},
+
+		{
+			q:   "watermark=42&watermark_scale=120",
+			err: "invalid watermark: scale 120 must be between 0 and 100",
+		},
+
+		{
+			q: "watermark=42&text=Hi+there&text_size=20&text_stroke=2,ffffff",
+			p: "text:SGkgdGhlcmU:regular:20:000000:south:0:2,ffffff/watermark:42:southeast:0:100:0",
+		},
+
+		{
+			q:   "text=Hi&text_font=comic",
+			err: "invalid text: unknown font: comic",
+		},
+
+		{
+			q: "crop=smart&w=300&h=200&fit=cover",
+			p: "crop:smart:3,2/resize:300x200:cover:center",
+		},
+
+		{
+			q:   "crop=smart&w=300",
+			err: "invalid crop smart: w and h are required",
+		},
+
+		{
+			q: "strip=true",
+			p: "strip",
+		},
+
+		{
+			q:   "strip=maybe",
+			err: "invalid strip: maybe",
+		},
+
+		{
+			q:   "bg=red",
+			err: "invalid bg: red must be in RRGGBB hex form",
+		},
+
+		{
+			q: "frame=2&format=png&w=10",
+			p: "frame:2/resize:10x:inside:center/format:png",
+		},
+
+		{
+			q:   "frame=0",
+			err: "invalid frame: 0",
+		},
+	}
+
+	for _, c := range tests {
+		q, _ := url.ParseQuery(c.q)
+		p, err := parseQueryPipeline(q)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %s: %v", c.q, err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error %s for %s", c.err, c.q)
+		}
+
+		if p.String() != c.p {
+			t.Fatalf("expected %s but got %s", c.p, p)
+		}
+	}
+}
+
+func Test_parsePathPipeline(t *testing.T) {
+	tests := []struct {
+		path string
+		p    string
+		err  string
+	}{
+		{
+			path: "resize:400x300/format:png",
+			p:    "resize:400x300:inside:center/format:png",
+		},
+
+		{
+			path: "crop:200,100:north/resize:x50:cover:south/",
+			p:    "crop:200,100:north/resize:x50:cover:south",
+		},
+
+		{
+			path: "format:jpeg/crop:1,2,3,4/resize:10x/resize:5x5:fill",
+			p:    "crop:1,2,3,4/resize:10x:inside:center/resize:5x5:fill:center/format:jpeg",
+		},
+
+		{
+			path: "blurry:5",
+			err:  "unknown operation: blurry",
+		},
+
+		{
+			path: "resize:400",
+			err:  "invalid operation resize:400: invalid size: 400",
+		},
+
+		{
+			path: "resize:x",
+			err:  "invalid size: x",
+		},
+
+		{
+			path: "resize:10x10:stretch",
+			err:  "unknown fit: stretch",
+		},
+
+		{
+			path: "crop:10,10:up",
+			err:  "unknown gravity: up",
+		},
+
+		{
+			path: "format:png/format:jpeg",
+			err:  "format can only be given once",
+		},
+
+		{
+			path: "format",
+			err:  "invalid operation: format",
+		},
+
+		{
+			path: "resize:10x/frame:3",
+			p:    "frame:3/resize:10x:inside:center",
+		},
+
+		{
+			path: "lossless/quality:60/format:webp",
+			p:    "format:webp/quality:60/lossless",
+		},
+
+		{
+			path: "quality:0",
+			err:  "invalid quality: 0",
+		},
+
+		{
+			path: "compression:fast/format:png",
+			p:    "format:png/compression:fast",
+		},
+
+		{
+			path: "compression:none/compression:best",
+			err:  "compression can only be given once",
+		},
+
+		{
+			path: "bg:000000/format:jpeg",
+			p:    "format:jpeg/bg:000000",
+		},
+
+		{
+			path: "rotate:450/rotate:12.50/flip:v",
+			p:    "rotate:90/rotate:12.5/flip:v",
+		},
+
+		{
+			path: "rotate:NaN",
+			err:  "invalid operation rotate:NaN",
+		},
+
+		{
+			path: "flip",
+			err:  "invalid operation flip",
+		},
+
+		{
+			path: "watermark:42:north:10::25",
+			p:    "watermark:42:north:10:100:25",
+		},
+
+		{
+			path: "watermark:42:up",
+			err:  "invalid operation watermark:42:up: unknown position: up",
+		},
+
+		{
+			path: "text:SGkgdGhlcmU=:bold::ff0000:north",
+			p:    "text:SGkgdGhlcmU:bold:32:ff0000:north:0:0,000000",
+		},
+
+		{
+			path: "text:SGk:regular:32:000000:south:0:20",
+			err:  "invalid operation text:SGk:regular:32:000000:south:0:20: stroke 20 must be between 0 and 16",
+		},
+
+		{
+			path: "crop:smart:1920,1080/resize:320x",
+			p:    "crop:smart:16,9/resize:320x:inside:center",
+		},
+
+		{
+			path: "crop:smart",
+			err:  "invalid operation crop:smart: expected smart:w,h",
+		},
+
+		{
+			path: "strip/format:png",
+			p:    "format:png/strip",
+		},
+
+		{
+			path: "bg:00000",
+			err:  "invalid bg: 00000 must be in RRGGBB hex form",
+		},
+
+		{
+			path: "frame:1/frame:2",
+			err:  "frame can only be given once",
+		},
+
+		{
+			path: strings.Repeat("resize:10x/", maxOperations+1),
+			err:  "too many operations",
+		},
+	}
+
+	for _, c := range tests {
+		p, err := parsePathPipeline(c.path)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %s: %v", c.path, err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error %s for %s", c.err, c.path)
+		}
+
+		if p.String() != c.p {
+			t.Fatalf("expected %s but got %s", c.p, p)
+		}
+	}
+}
+
+func Test_transformImage_pipeline(t *testing.T) {
+	data, err := encodeImage(testImage(400, 200), "png", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	p, err := parsePathPipeline("crop:200,200:west/resize:100x/resize:50x40:fill/format:jpeg")
+	if err != nil {
+		t.Fatalf("unexpected error: parse: %v", err)
+	}
+
+	img := newImage("png", data)
+	err = transformImage(img, p)
+	if err != nil {
+		t.Fatalf("unexpected error: transform: %v", err)
+	}
+
+	gimg, err := getGoImage(img)
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	if img.Format != "jpeg" || gimg.Bounds() != image.Rect(0, 0, 50, 40) {
+		t.Fatalf("unexpected error: transformed image: %s %v", img.Format, gimg.Bounds())
+	}
+}
+
+func Test_transformImage_background(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	data, err := encodeImage(src, "png", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		at   image.Point
+		c    color.RGBA
+	}{
+		{
+			path: "format:jpeg",
+			at:   image.Pt(20, 10),
+			c:    whiteBackground,
+		},
+
+		{
+			path: "format:jpeg/bg:ff0000",
+			at:   image.Pt(20, 10),
+			c:    color.RGBA{0xff, 0, 0, 0xff},
+		},
+
+		{
+			path: "resize:40x40:contain/bg:0000ff",
+			at:   image.Pt(20, 5),
+			c:    color.RGBA{0, 0, 0xff, 0xff},
+		},
+	}
+
+	for _, c := range tests {
+		p, err := parsePathPipeline(c.path)
+		if err != nil {
+			t.Fatalf("unexpected error: parse: %v", err)
+		}
+
+		img := newImage("png", data)
+		err = transformImage(img, p)
+		if err != nil {
+			t.Fatalf("unexpected error: transform: %v", err)
+		}
+
+		gimg, err := getGoImage(img)
+		if err != nil {
+			t.Fatalf("unexpected error: decode: %v", err)
+		}
+
+		r, g, b, _ := gimg.At(c.at.X, c.at.Y).RGBA()
+		if absDiff(r>>8, uint32(c.c.R)) > 2 || absDiff(g>>8, uint32(c.c.G)) > 2 || absDiff(b>>8, uint32(c.c.B)) > 2 {
+			t.Fatalf("%s: expected %v but got %v", c.path, c.c, gimg.At(c.at.X, c.at.Y))
+		}
+	}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+
+	return b - a
+}
+
+func Test_pipeline_cacheKey(t *testing.T) {
+	settings := encoder
+	defer func() { encoder = settings }()
+
+	quality, best, black := settings, settings, settings
+	quality.quality = 60
+	best.compression = "best"
+	black.background = color.RGBA{0, 0, 0, 0xff}
+
+	tests := []struct {
+		path string
+		same bool // same: the key doesn't change with the server defaults
+	}{
+		{
+			path: "resize:10x/format:jpeg",
+		},
+
+		{
+			path: "resize:10x/format:jpeg/quality:50/compression:fast/bg:ff0000",
+			same: true,
+		},
+	}
+
+	for _, c := range tests {
+		p, err := parsePathPipeline(c.path)
+		if err != nil {
+			t.Fatalf("unexpected error: parse: %v", err)
+		}
+
+		keys := map[string]bool{}
+		for _, e := range []encoderSettings{settings, quality, best, black} {
+			encoder = e
+			key, err := p.cacheKey()
+			if err != nil {
+				t.Fatalf("unexpected error: cache key: %v", err)
+			}
+
+			keys[key] = true
+		}
+
+		if c.same && len(keys) != 1 || !c.same && len(keys) != 4 {
+			t.Fatalf("unexpected keys for %s: %v", c.path, keys)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package progimg
 
 import (
+	"context"
+	"expvar"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -12,15 +19,162 @@ func getRouter() http.Handler {
 	r := mux.NewRouter()
 	r.NotFoundHandler = http.HandlerFunc(handle404)
 	r.HandleFunc("/images/{id}", handleDownload).Methods("GET")
+	r.HandleFunc("/images/{id}", handleDelete).Methods("DELETE")
+	r.HandleFunc("/images/{id}/info", handleInfo).Methods("GET")
+	r.HandleFunc("/images/{id}/metadata", handleMetadata).Methods("GET")
+	r.HandleFunc("/images/{id}/{ops:.+}", handleDownload).Methods("GET")
 	r.HandleFunc("/images/", handleUpload).Methods("POST")
 	r.HandleFunc("/images", handleUpload).Methods("POST")
+	r.HandleFunc("/images/", handleList).Methods("GET")
+	r.HandleFunc("/images", handleList).Methods("GET")
 	return r
 }
 
-// StartImageServer will start the image server
-func StartImageServer(addr string) {
-	err := http.ListenAndServe(addr, recoverHandler(logHandler(getRouter())))
+// getAdminRouter returns a mux router with the urls served only on the admin address
+func getAdminRouter() http.Handler {
+	r := mux.NewRouter()
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	return r
+}
+
+// Config holds the image server configuration
+type Config struct {
+	Addr  string     // Addr: server address
+	Admin string     // Admin: address serving the expvar metrics at /debug/vars, empty disables it
+	Store ImageStore // Store: storage backend for the images
+	Index *Index     // Index: metadata index of the stored images
+	Cache *Cache     // Cache: cache of the transformed images
+
+	Workers   int // Workers: number of concurrent transformations, defaults to number of CPUs
+	QueueSize int // QueueSize: number of transformations that can wait for a worker
+
+	Quality     int    // Quality: default jpeg and webp quality, defaults to 75
+	MinQuality  int    // MinQuality: lower bound of the requested quality, defaults to 1
+	MaxQuality  int    // MaxQuality: upper bound of the requested quality, defaults to 100
+	Compression string // Compression: default png compression(none, fast, default, best)
+	Background  string // Background: default colour for the removed alpha in RRGGBB hex form
+
+	StripMetadata string // StripMetadata: metadata removed from the uploaded images(none, private, all)
+}
+
+// shutdownTimeout is how long the in-flight requests are given to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// StartImageServer will start the image server with given config
+// and serve until SIGINT or SIGTERM, shutting down gracefully
+func StartImageServer(c Config) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	return serve(c, stop)
+}
+
+// serve applies the config and serves until a value is received on stop
+// or one of the servers fails
+func serve(c Config, stop <-chan os.Signal) error {
+	if c.Store == nil {
+		return fmt.Errorf("no image store configured")
+	}
+
+	imageStore = c.Store
+	if c.Index != nil {
+		imageIndex = c.Index
+	}
+
+	if c.Cache != nil {
+		derivatives = c.Cache
+	}
+
+	if c.Workers > 0 {
+		transformPool = newWorkPool(c.Workers, c.QueueSize)
+	}
+
+	err := setEncoderSettings(c)
 	if err != nil {
-		log.Fatalf("failed to start server: %v\n", err)
+		return fmt.Errorf("invalid encoder settings: %v", err)
+	}
+
+	if c.StripMetadata != "" {
+		if !validStrip(c.StripMetadata) {
+			return fmt.Errorf("unknown metadata strip policy: %s", c.StripMetadata)
+		}
+
+		uploadStrip = c.StripMetadata
+	}
+
+	servers := []*http.Server{{Addr: c.Addr, Handler: recoverHandler(logHandler(getRouter()))}}
+	if c.Admin != "" {
+		servers = append(servers, &http.Server{Addr: c.Admin, Handler: getAdminRouter()})
 	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.ListenAndServe()
+			if err != http.ErrServerClosed {
+				errs <- fmt.Errorf("failed to serve %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	select {
+	case err = <-errs:
+	case sig := <-stop:
+		log.Printf("received %v, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		serr := srv.Shutdown(ctx)
+		if err == nil && serr != nil {
+			err = fmt.Errorf("failed to shutdown %s: %v", srv.Addr, serr)
+		}
+	}
+
+	return err
+}
+
+// setEncoderSettings applies the encoder defaults and bounds of the config
+func setEncoderSettings(c Config) error {
+	e := encoder
+	if c.MinQuality != 0 {
+		e.minQuality = c.MinQuality
+	}
+
+	if c.MaxQuality != 0 {
+		e.maxQuality = c.MaxQuality
+	}
+
+	if e.minQuality < 1 || e.maxQuality > 100 || e.minQuality > e.maxQuality {
+		return fmt.Errorf("quality bounds must be within 1 and 100: %d-%d", e.minQuality, e.maxQuality)
+	}
+
+	if c.Quality != 0 {
+		e.quality = c.Quality
+	}
+
+	if e.quality < e.minQuality || e.quality > e.maxQuality {
+		return fmt.Errorf("quality %d is out of bounds %d-%d", e.quality, e.minQuality, e.maxQuality)
+	}
+
+	if c.Compression != "" {
+		if _, ok := pngCompressions[c.Compression]; !ok {
+			return fmt.Errorf("unknown compression: %s", c.Compression)
+		}
+
+		e.compression = c.Compression
+	}
+
+	if c.Background != "" {
+		bg, err := parseColor(c.Background)
+		if err != nil {
+			return fmt.Errorf("invalid background: %v", err)
+		}
+
+		e.background = bg
+	}
+
+	encoder = e
+	return nil
 }
@@ -0,0 +1,158 @@
+package progimg
+
+import (
+	"image/color"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_setEncoderSettings(t *testing.T) {
+	tests := []struct {
+		c   Config
+		e   encoderSettings
+		err string
+	}{
+		{
+			e: encoderSettings{quality: 75, minQuality: 1, maxQuality: 100, compression: "default",
+				background: whiteBackground},
+		},
+
+		{
+			c: Config{Quality: 60, MinQuality: 40, MaxQuality: 90, Compression: "fast", Background: "00ff80"},
+			e: encoderSettings{quality: 60, minQuality: 40, maxQuality: 90, compression: "fast",
+				background: color.RGBA{0x00, 0xff, 0x80, 0xff}},
+		},
+
+		{
+			c:   Config{MaxQuality: 50},
+			err: "quality 75 is out of bounds 1-50",
+		},
+
+		{
+			c:   Config{MinQuality: 60, MaxQuality: 50},
+			err: "quality bounds must be within 1 and 100: 60-50",
+		},
+
+		{
+			c:   Config{Compression: "max"},
+			err: "unknown compression: max",
+		},
+
+		{
+			c:   Config{Background: "#fff"},
+			err: "invalid background: #fff must be in RRGGBB hex form",
+		},
+	}
+
+	settings := encoder
+	defer func() { encoder = settings }()
+	for _, c := range tests {
+		encoder = settings
+		err := setEncoderSettings(c.c)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error: %s", c.err)
+		}
+
+		if encoder != c.e {
+			t.Fatalf("expected %v but got %v", c.e, encoder)
+		}
+	}
+}
+
+func Test_serve(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: listen: %v", err)
+	}
+	defer busy.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: listen: %v", err)
+	}
+
+	free := l.Addr().String()
+	l.Close()
+
+	store := imageStore
+	defer func() { imageStore = store }()
+	tests := []struct {
+		c   Config
+		err string
+	}{
+		{
+			c:   Config{Addr: free},
+			err: "no image store configured",
+		},
+
+		{
+			c:   Config{Addr: free, Store: store, StripMetadata: "some"},
+			err: "unknown metadata strip policy: some",
+		},
+
+		{
+			c:   Config{Addr: busy.Addr().String(), Store: store},
+			err: "failed to serve " + busy.Addr().String(),
+		},
+
+		{
+			c: Config{Addr: free, Store: store},
+		},
+	}
+
+	for _, c := range tests {
+		stop := make(chan os.Signal, 1)
+		done := make(chan error, 1)
+		go func(c Config) { done <- serve(c, stop) }(c.c)
+
+		// the server is stopped once it answers
+		if c.err == "" {
+			for i := 0; ; i++ {
+				resp, err := http.Get("http://" + c.c.Addr + "/unknown")
+				if err == nil {
+					resp.Body.Close()
+					break
+				}
+
+				if i == 100 {
+					t.Fatalf("unexpected error: server not up: %v", err)
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			stop <- os.Interrupt
+		}
+
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server didn't stop for %s", c.c.Addr)
+		}
+
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error: %s", c.err)
+		}
+	}
+}
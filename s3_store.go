@@ -0,0 +1,449 @@
+package progimg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minPartSize is the smallest part size S3 accepts for all but the last part
+const minPartSize = 5 << 20
+
+// S3Config holds the details required to talk to an S3 compatible store
+type S3Config struct {
+	Endpoint  string // Endpoint: base url of the S3 api, eg: http://localhost:9000
+	Region    string // Region: region used to sign the requests
+	Bucket    string // Bucket: bucket that holds the images
+	Prefix    string // Prefix: optional key prefix for the images
+	AccessKey string // AccessKey: access key id
+	SecretKey string // SecretKey: secret access key
+	PartSize  int    // PartSize: images larger than this are uploaded in parts
+}
+
+// s3Store stores the images as objects in an S3 compatible bucket
+// Objects are addressed path style(endpoint/bucket/key) so that it works with MinIO like servers
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewS3Store returns an ImageStore backed by an S3 compatible bucket
+func NewS3Store(c S3Config) (ImageStore, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", c.Endpoint)
+	}
+
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+
+	if c.PartSize < minPartSize {
+		c.PartSize = minPartSize
+	}
+
+	return &s3Store{
+		endpoint:  u,
+		region:    c.Region,
+		bucket:    c.Bucket,
+		prefix:    c.Prefix,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		partSize:  c.PartSize,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// s3Error is the error document returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// initiateMultipartUploadResult is the response of create multipart upload
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// completedPart is a single uploaded part of a multipart upload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeMultipartUpload is the request body of complete multipart upload
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// key returns the object key of the image
+func (s *s3Store) key(id string) string {
+	return s.prefix + id
+}
+
+// objectURL constructs the url for the given key and query
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do signs and sends the request
+// responses with status other than 2xx are returned as errors along with the status code
+func (s *s3Store) do(method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 request: %v", err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	signRequest(req, body, s.accessKey, s.secretKey, s.region, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s failed: %v", method, u.Path, err)
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	d, _ := ioutil.ReadAll(resp.Body)
+	var se s3Error
+	xml.Unmarshal(d, &se)
+	if se.Code == "" {
+		se.Code = resp.Status
+	}
+
+	return resp, fmt.Errorf("s3 %s %s failed: %s: %s", method, u.Path, se.Code, se.Message)
+}
+
+// Put uploads the image as an object, using multipart upload for large images
+func (s *s3Store) Put(img *Image) error {
+	header := http.Header{}
+	header.Set("Content-Type", fmt.Sprintf("image/%s", img.Format))
+	if len(img.Data) > s.partSize {
+		return s.putMultipart(img, header)
+	}
+
+	resp, err := s.do("PUT", s.objectURL(s.key(img.ID), nil), header, img.Data)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart uploads the image in parts of partSize
+func (s *s3Store) putMultipart(img *Image, header http.Header) error {
+	key := s.key(img.ID)
+	resp, err := s.do("POST", s.objectURL(key, url.Values{"uploads": {""}}), header, nil)
+	if err != nil {
+		return err
+	}
+
+	var ir initiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&ir)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode s3 multipart upload: %v", err)
+	}
+
+	var parts []completedPart
+	for off := 0; off < len(img.Data); off += s.partSize {
+		end := off + s.partSize
+		if end > len(img.Data) {
+			end = len(img.Data)
+		}
+
+		n := len(parts) + 1
+		resp, err = s.do("PUT", s.objectURL(key, url.Values{
+			"partNumber": {strconv.Itoa(n)},
+			"uploadId":   {ir.UploadID},
+		}), nil, img.Data[off:end])
+		if err != nil {
+			s.abortMultipart(key, ir.UploadID)
+			return err
+		}
+
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		s.abortMultipart(key, ir.UploadID)
+		return fmt.Errorf("failed to encode s3 multipart completion: %v", err)
+	}
+
+	resp, err = s.do("POST", s.objectURL(key, url.Values{"uploadId": {ir.UploadID}}), nil, body)
+	if err != nil {
+		s.abortMultipart(key, ir.UploadID)
+		return err
+	}
+
+	// S3 can fail the completion with a 200 response and an error document
+	defer resp.Body.Close()
+	d, _ := ioutil.ReadAll(resp.Body)
+	var se s3Error
+	if xml.Unmarshal(d, &se) == nil && se.Code != "" {
+		return fmt.Errorf("s3 multipart upload of %s failed: %s: %s", key, se.Code, se.Message)
+	}
+
+	return nil
+}
+
+// abortMultipart aborts the multipart upload so that the parts are not left behind
+func (s *s3Store) abortMultipart(key, uploadID string) {
+	resp, err := s.do("DELETE", s.objectURL(key, url.Values{"uploadId": {uploadID}}), nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Get downloads the image object
+func (s *s3Store) Get(id string) (*Image, error) {
+	resp, err := s.do("GET", s.objectURL(s.key(id), nil), nil, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, ErrImageNotFound
+		}
+
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read s3 object %s: %v", id, err)
+	}
+
+	return &Image{
+		ID:     id,
+		Format: strings.TrimPrefix(resp.Header.Get("Content-Type"), "image/"),
+		Data:   d,
+	}, nil
+}
+
+// Delete removes the image object
+// S3 doesn't report missing objects on delete, so the object is checked first
+func (s *s3Store) Delete(id string) error {
+	_, err := s.Stat(id)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("DELETE", s.objectURL(s.key(id), nil), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// Stat returns the image details from the object headers
+func (s *s3Store) Stat(id string) (*ImageStat, error) {
+	resp, err := s.do("HEAD", s.objectURL(s.key(id), nil), nil, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, ErrImageNotFound
+		}
+
+		return nil, err
+	}
+
+	resp.Body.Close()
+	mt, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ImageStat{
+		ID:      id,
+		Format:  strings.TrimPrefix(resp.Header.Get("Content-Type"), "image/"),
+		Size:    resp.ContentLength,
+		ModTime: mt,
+		ETag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+// List returns the ids of all the image objects under prefix
+func (s *s3Store) List() ([]string, error) {
+	var ids []string
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}}
+		if s.prefix != "" {
+			q.Set("prefix", s.prefix)
+		}
+
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", s.objectURL("", q), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var lr listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode s3 object list: %v", err)
+		}
+
+		for _, c := range lr.Contents {
+			ids = append(ids, strings.TrimPrefix(c.Key, s.prefix))
+		}
+
+		if !lr.IsTruncated || lr.NextContinuationToken == "" {
+			return ids, nil
+		}
+
+		token = lr.NextContinuationToken
+	}
+}
+
+// signRequest signs the request using AWS signature version 4
+// host and all the headers set on the request are signed
+func signRequest(req *http.Request, body []byte, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var ch bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&ch, "%s:%s\n", k, headers[k])
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		ch.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalURI uri encodes each segment of the path
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		segs[i] = uriEncode(s)
+	}
+
+	return strings.Join(segs, "/")
+}
+
+// canonicalQuery returns the encoded query sorted by key
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes everything except the unreserved characters as required by signature v4
+func uriEncode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+
+	return buf.String()
+}
+
+// hmacSHA256 returns the hmac of data using key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,206 @@
+package progimg
+
+import (
+	"image"
+	"math"
+)
+
+// smartCrop is the crop value that picks the crop window by its content
+const smartCrop = "smart"
+
+// smart crop tuning
+const (
+	smartAnalysisSize = 256 // longest side of the downscaled image that is scored
+	smartEntropyBins  = 16  // luma histogram bins of the entropy score
+	smartSkinWeight   = 2   // weight of the skin tone score against the edge score
+	smartEntropyBias  = 0.1 // weight of the normalized entropy score against the edge score
+)
+
+// skinTone is the normalized reference colour of skin
+var skinTone = normalizeRGB(0.78, 0.57, 0.44)
+
+// normalizeRGB scales the colour to unit length
+func normalizeRGB(r, g, b float64) [3]float64 {
+	mag := math.Sqrt(r*r + g*g + b*b)
+	if mag == 0 {
+		return [3]float64{}
+	}
+
+	return [3]float64{r / mag, g / mag, b / mag}
+}
+
+// aspectRect returns the largest rectangle of the aspect ratio that fits in size
+func aspectRect(size, aspect image.Point) image.Point {
+	w, h := size.X, size.Y
+	if w*aspect.Y > h*aspect.X {
+		w = clampDim(int(math.Round(float64(h*aspect.X)/float64(aspect.Y))), size.X)
+	} else {
+		h = clampDim(int(math.Round(float64(w*aspect.Y)/float64(aspect.X))), size.Y)
+	}
+
+	return image.Pt(w, h)
+}
+
+// smartCropRect returns the largest window of the aspect ratio relative to image origin
+// that has the most edges, skin tones and luma entropy
+// ties are broken in favour of the window closest to the center
+func smartCropRect(src image.Image, aspect image.Point) image.Rectangle {
+	b := src.Bounds()
+	size := aspectRect(b.Size(), aspect)
+	if size == b.Size() {
+		return image.Rectangle{Max: size}
+	}
+
+	// score a downscaled copy, the window only moves along one axis
+	r := math.Min(1, float64(smartAnalysisSize)/float64(maxInt(b.Dx(), b.Dy())))
+	aw, ah := scaleDim(b.Dx(), r), scaleDim(b.Dy(), r)
+	small := scaleImage(src, b, aw, ah)
+	rx, ry := float64(aw)/float64(b.Dx()), float64(ah)/float64(b.Dy())
+	win := image.Pt(clampDim(int(math.Round(float64(size.X)*rx)), aw), clampDim(int(math.Round(float64(size.Y)*ry)), ah))
+	scores := newSaliency(small)
+
+	horizontal := size.X < b.Dx()
+	span := ah - win.Y
+	if horizontal {
+		span = aw - win.X
+	}
+
+	best, bestScore := span/2, math.Inf(-1)
+	for off := 0; off <= span; off++ {
+		w := image.Rectangle{Max: win}
+		if horizontal {
+			w = w.Add(image.Pt(off, 0))
+		} else {
+			w = w.Add(image.Pt(0, off))
+		}
+
+		s := scores.score(w)
+		if s > bestScore+1e-9 || math.Abs(s-bestScore) <= 1e-9 && abs(off-span/2) < abs(best-span/2) {
+			best, bestScore = off, s
+		}
+	}
+
+	// map the window back to the full image
+	min := image.Point{}
+	if horizontal {
+		min.X = int(math.Round(float64(best) / rx))
+		if min.X > b.Dx()-size.X {
+			min.X = b.Dx() - size.X
+		}
+	} else {
+		min.Y = int(math.Round(float64(best) / ry))
+		if min.Y > b.Dy()-size.Y {
+			min.Y = b.Dy() - size.Y
+		}
+	}
+
+	return image.Rectangle{Min: min, Max: min.Add(size)}
+}
+
+// saliency holds the summed area tables of the per pixel scores
+type saliency struct {
+	stride  int
+	edge    []float64                 // edge: sum of the luma laplacian magnitudes
+	skin    []float64                 // skin: sum of the skin tone closeness
+	entropy [smartEntropyBins][]int32 // entropy: luma histogram counts
+}
+
+// newSaliency scores the pixels of the image
+func newSaliency(img *image.RGBA) *saliency {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	luma := make([]float64, w*h)
+	s := &saliency{
+		stride: w + 1,
+		edge:   make([]float64, (w+1)*(h+1)),
+		skin:   make([]float64, (w+1)*(h+1)),
+	}
+
+	for i := range s.entropy {
+		s.entropy[i] = make([]int32, (w+1)*(h+1))
+	}
+
+	skins := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			r, g, b := float64(p[0])/0xff, float64(p[1])/0xff, float64(p[2])/0xff
+			l := 0.299*r + 0.587*g + 0.114*b
+			luma[y*w+x] = l
+
+			// skin tones are close to the reference colour and neither too dark nor too bright
+			c := normalizeRGB(r, g, b)
+			d := math.Sqrt((c[0]-skinTone[0])*(c[0]-skinTone[0]) +
+				(c[1]-skinTone[1])*(c[1]-skinTone[1]) + (c[2]-skinTone[2])*(c[2]-skinTone[2]))
+			if l > 0.2 && l < 0.95 && d < 0.1 {
+				skins[y*w+x] = 1 - d/0.1
+			}
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := luma[y*w+x]
+			edge := math.Abs(4*l - luma[y*w+clampIndex(x-1, w)] - luma[y*w+clampIndex(x+1, w)] -
+				luma[clampIndex(y-1, h)*w+x] - luma[clampIndex(y+1, h)*w+x])
+			bin := minInt(int(l*smartEntropyBins), smartEntropyBins-1)
+
+			i, up := (y+1)*s.stride+x+1, y*s.stride+x+1
+			s.edge[i] = edge + s.edge[i-1] + s.edge[up] - s.edge[up-1]
+			s.skin[i] = skins[y*w+x] + s.skin[i-1] + s.skin[up] - s.skin[up-1]
+			for k := range s.entropy {
+				e := s.entropy[k]
+				e[i] = e[i-1] + e[up] - e[up-1]
+				if k == bin {
+					e[i]++
+				}
+			}
+		}
+	}
+
+	return s
+}
+
+// score returns the score of the window of the scored image
+func (s *saliency) score(r image.Rectangle) float64 {
+	a, b := r.Min.Y*s.stride+r.Min.X, r.Min.Y*s.stride+r.Max.X
+	c, d := r.Max.Y*s.stride+r.Min.X, r.Max.Y*s.stride+r.Max.X
+	n := float64(r.Dx() * r.Dy())
+
+	edge := (s.edge[d] - s.edge[b] - s.edge[c] + s.edge[a]) / n
+	skin := (s.skin[d] - s.skin[b] - s.skin[c] + s.skin[a]) / n
+	var entropy float64
+	for _, e := range s.entropy {
+		if p := float64(e[d]-e[b]-e[c]+e[a]) / n; p > 0 {
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return edge + smartSkinWeight*skin + smartEntropyBias*entropy/math.Log2(smartEntropyBins)
+}
+
+// abs returns the absolute value of v
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// maxInt returns the larger of a and b
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
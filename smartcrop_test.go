@@ -0,0 +1,75 @@
+package progimg
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_smartCropRect(t *testing.T) {
+	flat := func(w, h int) *image.NRGBA {
+		m := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for i := range m.Pix {
+			m.Pix[i] = 0xe0
+		}
+
+		return m
+	}
+
+	// checkered subject near the right edge
+	edges := flat(600, 200)
+	for y := 40; y < 160; y++ {
+		for x := 460; x < 580; x++ {
+			if (x/4+y/4)%2 == 0 {
+				edges.SetNRGBA(x, y, color.NRGBA{0x10, 0x10, 0x10, 0xff})
+			}
+		}
+	}
+
+	// skin toned subject near the top edge
+	skin := flat(100, 400)
+	for y := 10; y < 70; y++ {
+		for x := 20; x < 80; x++ {
+			skin.SetNRGBA(x, y, color.NRGBA{0xc7, 0x91, 0x70, 0xff})
+		}
+	}
+
+	tests := []struct {
+		img    image.Image
+		aspect image.Point
+		within image.Rectangle
+	}{
+		{
+			img:    edges,
+			aspect: image.Pt(1, 1),
+			within: image.Rect(380, 0, 600, 200),
+		},
+
+		{
+			img:    skin,
+			aspect: image.Pt(1, 1),
+			within: image.Rect(0, 0, 100, 120),
+		},
+
+		{
+			// nothing stands out so the window is centered
+			img:    flat(400, 100),
+			aspect: image.Pt(2, 1),
+			within: image.Rect(100, 0, 300, 100),
+		},
+
+		{
+			img:    flat(400, 100),
+			aspect: image.Pt(4, 1),
+			within: image.Rect(0, 0, 400, 100),
+		},
+	}
+
+	for _, c := range tests {
+		r := smartCropRect(c.img, c.aspect)
+		size := aspectRect(c.img.Bounds().Size(), c.aspect)
+		if r.Size() != size || !r.In(c.within) {
+			t.Fatalf("expected %v within %v but got %v", size, c.within, r)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package progimg
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrImageNotFound is returned by the stores when no image matches the id
+var ErrImageNotFound = errors.New("image not found")
+
+// ImageStat holds the details of a stored image without its data
+type ImageStat struct {
+	ID      string    // ID: unique ID for image
+	Format  string    // Format: image format
+	Size    int64     // Size: size of the image data in bytes
+	ModTime time.Time // ModTime: last time the image was written to store
+	ETag    string    // ETag: opaque tag that changes with the image data
+}
+
+// ImageStore is implemented by the storage backends that hold the images
+type ImageStore interface {
+	// Put saves the image, replacing any image with the same id
+	Put(img *Image) error
+
+	// Get returns the image with given id
+	Get(id string) (*Image, error)
+
+	// Delete removes the image with given id
+	Delete(id string) error
+
+	// Stat returns the details of the image with given id
+	Stat(id string) (*ImageStat, error)
+
+	// List returns the ids of all the stored images
+	List() ([]string, error)
+}
+
+// imageStore is the store used by the handlers
+var imageStore ImageStore
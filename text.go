@@ -0,0 +1,387 @@
+package progimg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// text overlay limits
+const (
+	maxTextLength = 512 // maximum length of the text in bytes
+	maxTextSize   = 512 // maximum font size in pixels
+	maxTextStroke = 16  // maximum stroke width in pixels
+
+	// maxTextArea bounds size x size x characters of the text as a multiple of the image area
+	maxTextArea = 16
+)
+
+// textFonts maps the font names to the embedded fonts
+var textFonts map[string]*opentype.Font
+
+// textOp renders text over the image
+type textOp struct {
+	text        string     // text: lines of text separated by new lines
+	font        string     // font: name of the embedded font
+	size        int        // size: font size in pixels
+	color       color.RGBA // color: colour of the text
+	position    string     // position: gravity of the text within the margins, also aligns the lines
+	margin      int        // margin: pixels kept clear between the text and the edges
+	stroke      int        // stroke: width of the outline around the text, 0 for none
+	strokeColor color.RGBA // strokeColor: colour of the outline
+}
+
+// textArgs are the arguments of a text overlay, empty arguments take their defaults
+type textArgs struct {
+	text, font, size, color, position, margin, stroke string
+}
+
+// parseTextOp parses the text overlay arguments
+func parseTextOp(a textArgs) (*textOp, error) {
+	text := strings.Replace(a.text, "\r", "", -1)
+	if strings.TrimSpace(text) == "" || len(text) > maxTextLength || !utf8.ValidString(text) {
+		return nil, fmt.Errorf("text must be valid utf-8 of upto %d bytes", maxTextLength)
+	}
+
+	op := &textOp{
+		text:        text,
+		font:        "regular",
+		size:        32,
+		color:       color.RGBA{0, 0, 0, 0xff},
+		position:    "south",
+		strokeColor: color.RGBA{0, 0, 0, 0xff},
+	}
+
+	if a.font != "" {
+		if _, ok := textFonts[a.font]; !ok {
+			return nil, fmt.Errorf("unknown font: %s", a.font)
+		}
+
+		op.font = a.font
+	}
+
+	var err error
+	if a.size != "" {
+		op.size, err = parseDim(a.size, maxTextSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size: %v", err)
+		}
+	}
+
+	if a.color != "" {
+		op.color, err = parseColor(a.color)
+		if err != nil {
+			return nil, fmt.Errorf("invalid color: %v", err)
+		}
+	}
+
+	if a.position != "" {
+		if _, ok := gravities[a.position]; !ok {
+			return nil, fmt.Errorf("unknown position: %s", a.position)
+		}
+
+		op.position = a.position
+	}
+
+	if a.margin != "" {
+		op.margin, err = strconv.Atoi(a.margin)
+		if err != nil || op.margin < 0 || op.margin > maxDimension {
+			return nil, fmt.Errorf("margin %s must be between 0 and %d", a.margin, maxDimension)
+		}
+	}
+
+	if a.stroke != "" {
+		parts := strings.Split(a.stroke, ",")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("expected stroke width[,RRGGBB]")
+		}
+
+		op.stroke, err = strconv.Atoi(parts[0])
+		if err != nil || op.stroke < 0 || op.stroke > maxTextStroke {
+			return nil, fmt.Errorf("stroke %s must be between 0 and %d", parts[0], maxTextStroke)
+		}
+
+		if len(parts) == 2 {
+			op.strokeColor, err = parseColor(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid stroke color: %v", err)
+			}
+		}
+	}
+
+	return op, nil
+}
+
+// parseTextPathOp parses text:base64url[:font[:size[:color[:position[:margin[:stroke]]]]]]
+// the text is base64url encoded as the path can't carry every character
+func parseTextPathOp(args []string) (operation, error) {
+	if len(args) < 1 || len(args) > 7 {
+		return nil, fmt.Errorf("expected base64url[:font[:size[:color[:position[:margin[:stroke]]]]]]")
+	}
+
+	text, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(args[0], "="))
+	if err != nil {
+		return nil, fmt.Errorf("text must be base64url encoded")
+	}
+
+	a := make([]string, 7)
+	copy(a, args)
+	return parseTextOp(textArgs{
+		text:     string(text),
+		font:     a[1],
+		size:     a[2],
+		color:    a[3],
+		position: a[4],
+		margin:   a[5],
+		stroke:   a[6],
+	})
+}
+
+func (op *textOp) apply(src image.Image, _ color.Color) (image.Image, error) {
+	b := src.Bounds()
+	if op.size*op.size*utf8.RuneCountInString(op.text) > maxTextArea*b.Dx()*b.Dy() {
+		return nil, fmt.Errorf("text is too large for the %dx%d image", b.Dx(), b.Dy())
+	}
+
+	face, err := opentype.NewFace(textFonts[op.font], &opentype.FaceOptions{
+		Size:    float64(op.size),
+		DPI:     72,
+		Hinting: font.HintingNone,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	dst := toRGBA(src)
+	lines := strings.Split(op.text, "\n")
+	widths, size := textBlock(face, lines, op.stroke)
+	area := dst.Rect.Inset(op.margin)
+	if area.Empty() {
+		area = dst.Rect
+	}
+
+	// only the visible part of the text and the stroke reaching into it are rendered
+	r := gravityRect(area, size, op.position)
+	visible := r.Intersect(dst.Rect)
+	if visible.Empty() {
+		return dst, nil
+	}
+
+	clip := visible.Sub(r.Min).Inset(-op.stroke).Intersect(image.Rectangle{Max: size})
+	mask := textMask(face, lines, widths, gravities[op.position].X, op.stroke, clip)
+	mp := visible.Min.Sub(r.Min)
+	if op.stroke > 0 {
+		outline := dilateMask(mask, op.stroke)
+		draw.DrawMask(dst, visible, image.NewUniform(op.strokeColor), image.Point{}, outline, mp, draw.Over)
+	}
+
+	draw.DrawMask(dst, visible, image.NewUniform(op.color), image.Point{}, mask, mp, draw.Over)
+	return dst, nil
+}
+
+func (op *textOp) String() string {
+	c, s := op.color, op.strokeColor
+	return fmt.Sprintf("text:%s:%s:%d:%02x%02x%02x:%s:%d:%d,%02x%02x%02x",
+		base64.RawURLEncoding.EncodeToString([]byte(op.text)), op.font, op.size,
+		c.R, c.G, c.B, op.position, op.margin, op.stroke, s.R, s.G, s.B)
+}
+
+// textBlock returns the width of each line and the size of the text padded by pad pixels on each side
+func textBlock(face font.Face, lines []string, pad int) ([]int, image.Point) {
+	m := face.Metrics()
+	widths := make([]int, len(lines))
+	var width int
+	for i, line := range lines {
+		widths[i] = font.MeasureString(face, line).Ceil()
+		if widths[i] > width {
+			width = widths[i]
+		}
+	}
+
+	height := m.Height.Mul(fixed.I(len(lines)-1)) + m.Ascent + m.Descent
+	return widths, image.Pt(width+2*pad, height.Ceil()+2*pad)
+}
+
+// textMask renders the glyphs of the lines within clip to an alpha mask of the clip bounds
+// align places the shorter lines to the left(0), center(1) or right(2) of the longest
+func textMask(face font.Face, lines []string, widths []int, align, pad int, clip image.Rectangle) *image.Alpha {
+	m := face.Metrics()
+	var width int
+	for _, w := range widths {
+		if w > width {
+			width = w
+		}
+	}
+
+	mask := image.NewAlpha(clip)
+	d := &font.Drawer{Dst: mask, Src: image.Opaque, Face: face}
+	for i, line := range lines {
+		dot := fixed.Point26_6{
+			X: fixed.I(pad + (width-widths[i])*align/2),
+			Y: fixed.I(pad) + m.Ascent + m.Height.Mul(fixed.I(i)),
+		}
+
+		// lines and glyphs outside the clip are skipped without rasterizing them
+		if (dot.Y+m.Descent).Ceil() < clip.Min.Y || (dot.Y-m.Ascent).Floor() > clip.Max.Y {
+			continue
+		}
+
+		prev := rune(-1)
+		for _, c := range line {
+			if prev >= 0 {
+				dot.X += face.Kern(prev, c)
+			}
+
+			prev = c
+			// missing glyphs report the bounds of the notdef glyph drawn in their place
+			gb, advance, _ := face.GlyphBounds(c)
+
+			gr := image.Rect((dot.X + gb.Min.X).Floor(), (dot.Y + gb.Min.Y).Floor(),
+				(dot.X + gb.Max.X).Ceil(), (dot.Y + gb.Max.Y).Ceil())
+			if gr.Overlaps(clip) {
+				d.Dot = dot
+				d.DrawString(string(c))
+			}
+
+			dot.X += advance
+		}
+	}
+
+	return mask
+}
+
+// dilateMask grows the mask by a disk of radius r
+// the distance to the nearest covered pixel comes from a separable euclidean distance transform
+// so the cost doesn't depend on r, the edge of the disk is antialiased
+func dilateMask(src *image.Alpha, r int) *image.Alpha {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dist := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dist[y*w+x] = math.Inf(1)
+			if src.Pix[src.PixOffset(b.Min.X+x, b.Min.Y+y)] >= 0x80 {
+				dist[y*w+x] = 0
+			}
+		}
+	}
+
+	// columns then rows
+	n := w
+	if h > n {
+		n = h
+	}
+
+	f, d := make([]float64, n), make([]float64, n)
+	v, z := make([]int, n), make([]float64, n+1)
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			f[y] = dist[y*w+x]
+		}
+
+		distance1D(f[:h], d[:h], v, z)
+		for y := 0; y < h; y++ {
+			dist[y*w+x] = d[y]
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		copy(f, dist[y*w:(y+1)*w])
+		distance1D(f[:w], dist[y*w:(y+1)*w], v, z)
+	}
+
+	dst := image.NewAlpha(b)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := clampUnit(float64(r) + 0.5 - math.Sqrt(dist[y*w+x]))
+			if s := src.Pix[src.PixOffset(b.Min.X+x, b.Min.Y+y)]; s > a {
+				a = s
+			}
+
+			dst.Pix[dst.PixOffset(b.Min.X+x, b.Min.Y+y)] = a
+		}
+	}
+
+	return dst
+}
+
+// distance1D writes the squared distance transform of the sampled function f to d
+// using the lower envelope of parabolas, v and z are scratch space of len(f) and len(f)+1
+func distance1D(f, d []float64, v []int, z []float64) {
+	k := -1
+	for q := range f {
+		if math.IsInf(f[q], 1) {
+			continue
+		}
+
+		for k >= 0 {
+			p := v[k]
+			s := ((f[q] + float64(q*q)) - (f[p] + float64(p*p))) / float64(2*(q-p))
+			if s > z[k] {
+				k++
+				v[k], z[k] = q, s
+				break
+			}
+
+			k--
+		}
+
+		if k < 0 {
+			k = 0
+			v[0], z[0] = q, math.Inf(-1)
+		}
+
+		z[k+1] = math.Inf(1)
+	}
+
+	if k < 0 {
+		for q := range d {
+			d[q] = math.Inf(1)
+		}
+
+		return
+	}
+
+	k = 0
+	for q := range d {
+		for z[k+1] < float64(q) {
+			k++
+		}
+
+		p := v[k]
+		d[q] = float64((q-p)*(q-p)) + f[p]
+	}
+}
+
+func init() {
+	textFonts = make(map[string]*opentype.Font)
+	for name, ttf := range map[string][]byte{
+		"regular": goregular.TTF,
+		"bold":    gobold.TTF,
+		"italic":  goitalic.TTF,
+		"mono":    gomono.TTF,
+	} {
+		f, err := opentype.Parse(ttf)
+		if err != nil {
+			log.Fatalf("failed to parse %s font: %v\n", name, err)
+		}
+
+		textFonts[name] = f
+	}
+}
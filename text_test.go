@@ -0,0 +1,188 @@
+package progimg
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_textOp(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+
+	tests := []struct {
+		args textArgs
+		// inside is the region expected to hold all the coloured pixels
+		inside image.Rectangle
+		colors []color.RGBA
+		err    string
+	}{
+		{
+			args:   textArgs{text: "Hello", color: "ff0000", position: "northwest"},
+			inside: image.Rect(0, 0, 100, 40),
+			colors: []color.RGBA{{0xff, 0, 0, 0xff}},
+		},
+
+		{
+			args:   textArgs{text: "Hi\nthere", size: "20", color: "0000ff", position: "southeast", margin: "10", stroke: "2,00ff00"},
+			inside: image.Rect(100, 30, 190, 90),
+			colors: []color.RGBA{{0, 0, 0xff, 0xff}, {0, 0xff, 0, 0xff}},
+		},
+
+		{
+			args: textArgs{text: " \n "},
+			err:  "text must be valid utf-8",
+		},
+
+		{
+			args: textArgs{text: strings.Repeat("W", 512), size: "512", stroke: "16"},
+			err:  "text is too large for the 200x100 image",
+		},
+
+		{
+			args: textArgs{text: "Hi", size: "0"},
+			err:  "invalid size: 0 must be between 1 and 512",
+		},
+
+		{
+			args: textArgs{text: "Hi", stroke: "2,blue"},
+			err:  "invalid stroke color: blue must be in RRGGBB hex form",
+		},
+	}
+
+	for _, c := range tests {
+		op, err := parseTextOp(c.args)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gimg, err := op.apply(src, nil)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error: %s", c.err)
+		}
+
+		if gimg.Bounds() != src.Bounds() {
+			t.Fatalf("%s: unexpected bounds %v", op, gimg.Bounds())
+		}
+
+		found := make([]bool, len(c.colors))
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 200; x++ {
+				px := color.RGBAModel.Convert(gimg.At(x, y)).(color.RGBA)
+				if px == (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+					continue
+				}
+
+				if !image.Pt(x, y).In(c.inside) {
+					t.Fatalf("%s: unexpected pixel %v at %d,%d", op, px, x, y)
+				}
+
+				for i, want := range c.colors {
+					found[i] = found[i] || px == want
+				}
+			}
+		}
+
+		for i, ok := range found {
+			if !ok {
+				t.Fatalf("%s: expected pixels of %v", op, c.colors[i])
+			}
+		}
+	}
+}
+
+func Test_textOp_worstCase(t *testing.T) {
+	// the largest text allowed on the image is mostly outside of it
+	src := image.NewNRGBA(image.Rect(0, 0, 2048, 2048))
+	tests := []textArgs{
+		{text: strings.Repeat("W", 256), size: "512", stroke: "16", position: "center"},
+		{text: strings.Repeat("W\n", 128), size: "512", stroke: "16", position: "northwest"},
+		{text: strings.Repeat("W", 512), size: "362", stroke: "16", position: "east"},
+	}
+
+	for _, a := range tests {
+		op, err := parseTextOp(a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		start := time.Now()
+		_, err = op.apply(src, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if d := time.Since(start); d > 3*time.Second {
+			t.Fatalf("%s took %v", op, d)
+		}
+	}
+}
+
+func Test_dilateMask(t *testing.T) {
+	src := image.NewAlpha(image.Rect(5, 5, 45, 35))
+	for _, p := range []image.Point{{6, 6}, {20, 20}, {21, 20}, {44, 34}, {30, 10}} {
+		src.SetAlpha(p.X, p.Y, color.Alpha{0xff})
+	}
+
+	for _, r := range []int{1, 3, 8} {
+		dst := dilateMask(src, r)
+		for y := 5; y < 35; y++ {
+			for x := 5; x < 45; x++ {
+				// brute force disk
+				want := false
+				for sy := 5; sy < 35; sy++ {
+					for sx := 5; sx < 45; sx++ {
+						d := (sx-x)*(sx-x) + (sy-y)*(sy-y)
+						want = want || src.AlphaAt(sx, sy).A == 0xff && d <= r*r
+					}
+				}
+
+				if got := dst.AlphaAt(x, y).A >= 0x80; got != want {
+					t.Fatalf("radius %d: expected %v at %d,%d but got %v", r, want, x, y, dst.AlphaAt(x, y).A)
+				}
+			}
+		}
+	}
+}
+
+func Test_textOp_clip(t *testing.T) {
+	// text running past the image matches the same text on a wider image
+	op, err := parseTextOp(textArgs{text: "Clipped text\nruns past", size: "60", position: "west", stroke: "5,ff0000"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	small, err := op.apply(image.NewNRGBA(image.Rect(0, 0, 150, 160)), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wide, err := op.apply(image.NewNRGBA(image.Rect(0, 0, 800, 160)), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for y := 0; y < 160; y++ {
+		for x := 0; x < 150; x++ {
+			if small.At(x, y) != wide.At(x, y) {
+				t.Fatalf("expected %v at %d,%d but got %v", wide.At(x, y), x, y, small.At(x, y))
+			}
+		}
+	}
+}
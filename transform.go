@@ -0,0 +1,405 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+	"golang.org/x/image/tiff"
+)
+
+// maxDimension is the largest width or height an image can be resized to
+const maxDimension = 8192
+
+// maxPixels is the largest canvas in pixels a stored image is decoded to
+const maxPixels = maxDimension * maxDimension
+
+// maxAnimationPixels is the largest number of frames x canvas pixels an animation is decoded to
+const maxAnimationPixels = 4 * maxPixels
+
+// maxCropDimension is the largest crop offset, width or height
+const maxCropDimension = 1 << 16
+
+// resize fit modes
+const (
+	fitInside  = "inside"  // fit within width x height preserving aspect ratio
+	fitContain = "contain" // fit within width x height preserving aspect ratio and pad the rest
+	fitCover   = "cover"   // fill width x height preserving aspect ratio and crop the overflow
+	fitFill    = "fill"    // stretch to width x height ignoring aspect ratio
+)
+
+// gravities maps the gravity to the anchor of the crop within the image
+// anchor is the fraction of the left over space placed before the crop on each axis
+var gravities = map[string]image.Point{
+	"center":    {1, 1},
+	"north":     {1, 0},
+	"south":     {1, 2},
+	"east":      {2, 1},
+	"west":      {0, 1},
+	"northeast": {2, 0},
+	"northwest": {0, 0},
+	"southeast": {2, 2},
+	"southwest": {0, 2},
+}
+
+// lanczos is the lanczos3 resampling kernel used while downscaling
+var lanczos = &xdraw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+
+		pt := math.Pi * t
+		return 3 * math.Sin(pt) * math.Sin(pt/3) / (pt * pt)
+	},
+}
+
+// defaultQuality is the jpeg and webp quality when none is given
+const defaultQuality = 75
+
+// pngCompressions maps the png compression names to the compression levels
+var pngCompressions = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// encoderSettings holds the server defaults and bounds of the encoding options
+type encoderSettings struct {
+	quality     int        // quality: default jpeg and webp quality
+	minQuality  int        // minQuality: lower bound of the requested quality
+	maxQuality  int        // maxQuality: upper bound of the requested quality
+	compression string     // compression: default png compression
+	background  color.RGBA // background: default colour for the removed alpha
+}
+
+// encoder is the encoder settings of the server
+var encoder = encoderSettings{
+	quality:     defaultQuality,
+	minQuality:  1,
+	maxQuality:  100,
+	compression: "default",
+	background:  whiteBackground,
+}
+
+// clampQuality bounds the requested quality as per the server settings
+func clampQuality(q int) int {
+	if q < encoder.minQuality {
+		return encoder.minQuality
+	}
+
+	if q > encoder.maxQuality {
+		return encoder.maxQuality
+	}
+
+	return q
+}
+
+// encodeOptions tune the encoding of the output image
+type encodeOptions struct {
+	quality     int         // quality: jpeg and lossy webp quality between 1 and 100, 0 for the default
+	lossless    bool        // lossless: encode webp without loss
+	compression string      // compression: png compression, empty for the default
+	background  *color.RGBA // background: colour for the removed alpha, nil for the default
+}
+
+// effective returns the options with the server defaults filled in
+func (o *encodeOptions) effective() encodeOptions {
+	e := *o
+	if e.quality == 0 {
+		e.quality = encoder.quality
+	}
+
+	if e.compression == "" {
+		e.compression = encoder.compression
+	}
+
+	bg := o.bg()
+	e.background = &bg
+	return e
+}
+
+// bg returns the colour for the removed alpha
+func (o *encodeOptions) bg() color.RGBA {
+	if o.background != nil {
+		return *o.background
+	}
+
+	return encoder.background
+}
+
+// parseColor parses a colour in RRGGBB hex form
+func parseColor(v string) (color.RGBA, error) {
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != 3 {
+		return color.RGBA{}, fmt.Errorf("%s must be in RRGGBB hex form", v)
+	}
+
+	return color.RGBA{b[0], b[1], b[2], 0xff}, nil
+}
+
+// encodeImage encodes the image to rct format, opts can be nil for the defaults
+func encodeImage(gimg image.Image, rct string, opts *encodeOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &encodeOptions{}
+	}
+
+	e := opts.effective()
+	quality, compression := e.quality, e.compression
+	var buf bytes.Buffer
+	var err error
+	switch rct {
+	case "png":
+		enc := &png.Encoder{CompressionLevel: pngCompressions[compression]}
+		err = enc.Encode(&buf, gimg)
+	case "jpeg":
+		dst := image.NewRGBA(gimg.Bounds())
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(opts.bg()),
+			image.Point{}, draw.Src)
+		draw.Draw(dst, dst.Bounds(), gimg, gimg.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	case "gif":
+		// leave room in the palette for a transparent colour
+		err = gif.Encode(&buf, palettedImage(gimg, palette.Plan9[:255], draw.FloydSteinberg), nil)
+	case "webp":
+		err = encodeWebP(&buf, gimg, quality, opts.lossless)
+	case "bmp":
+		err = bmp.Encode(&buf, gimg)
+	case "tiff":
+		err = tiff.Encode(&buf, gimg, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		err = fmt.Errorf("unknown conversion format: %s", rct)
+	}
+
+	return buf.Bytes(), err
+}
+
+// gravityRect places a rectangle of size within bounds as per gravity
+func gravityRect(bounds image.Rectangle, size image.Point, gravity string) image.Rectangle {
+	a, ok := gravities[gravity]
+	if !ok {
+		a = gravities["center"]
+	}
+
+	space := bounds.Size().Sub(size)
+	min := bounds.Min.Add(image.Pt(space.X*a.X/2, space.Y*a.Y/2))
+	return image.Rectangle{Min: min, Max: min.Add(size)}
+}
+
+// subImager is implemented by the images that can share pixels with a sub region
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// cropImage crops the image to the rect relative to image origin
+// or to a region of size placed by gravity when rect is empty
+// the crop is clipped to the image bounds
+func cropImage(src image.Image, rect image.Rectangle, size image.Point, gravity string) (image.Image, error) {
+	b := src.Bounds()
+	if rect.Empty() {
+		if size.X > b.Dx() {
+			size.X = b.Dx()
+		}
+
+		if size.Y > b.Dy() {
+			size.Y = b.Dy()
+		}
+
+		rect = gravityRect(b, size, gravity)
+	} else {
+		rect = rect.Add(b.Min).Intersect(b)
+	}
+
+	if rect.Empty() {
+		return nil, fmt.Errorf("crop is outside the image bounds %dx%d", b.Dx(), b.Dy())
+	}
+
+	if si, ok := src.(subImager); ok {
+		return si.SubImage(rect), nil
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, rect.Min, draw.Src)
+	return dst, nil
+}
+
+// resizeImage resizes the image to width x height as per fit
+// a zero width or height is derived from the other preserving the aspect ratio
+// gravity decides the region kept by cover fit and bg pads the contain fit
+func resizeImage(src image.Image, w, h int, fit, gravity string, bg color.Color) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw == 0 || sh == 0 {
+		return src
+	}
+
+	switch {
+	case w == 0:
+		w = scaleDim(sw, float64(h)/float64(sh))
+		fit = fitFill
+	case h == 0:
+		h = scaleDim(sh, float64(w)/float64(sw))
+		fit = fitFill
+	}
+
+	rx, ry := float64(w)/float64(sw), float64(h)/float64(sh)
+	switch fit {
+	case fitInside:
+		r := math.Min(rx, ry)
+		return scaleImage(src, b, scaleDim(sw, r), scaleDim(sh, r))
+	case fitContain:
+		r := math.Min(rx, ry)
+		scaled := scaleImage(src, b, scaleDim(sw, r), scaleDim(sh, r))
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		sb := scaled.Bounds()
+		off := image.Pt((w-sb.Dx())/2, (h-sb.Dy())/2)
+		draw.Draw(dst, sb.Add(off), scaled, sb.Min, draw.Over)
+		return dst
+	case fitCover:
+		// only the source region with the target aspect ratio is scaled
+		r := math.Max(rx, ry)
+		cw := clampDim(int(math.Round(float64(w)/r)), sw)
+		ch := clampDim(int(math.Round(float64(h)/r)), sh)
+		return scaleImage(src, gravityRect(b, image.Pt(cw, ch), gravity), w, h)
+	}
+
+	return scaleImage(src, b, w, h)
+}
+
+// scaleImage scales the sr region of src to w x h
+// lanczos is used to downscale and catmull-rom to upscale
+func scaleImage(src image.Image, sr image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	var k *xdraw.Kernel = lanczos
+	if w > sr.Dx() || h > sr.Dy() {
+		k = xdraw.CatmullRom
+	}
+
+	k.Scale(dst, dst.Bounds(), src, sr, xdraw.Src, nil)
+	return dst
+}
+
+// scaleDim scales the dimension by r keeping it within 1 and maxDimension
+func scaleDim(d int, r float64) int {
+	return clampDim(int(math.Round(float64(d)*r)), maxDimension)
+}
+
+// clampDim keeps the dimension within 1 and max
+func clampDim(d, max int) int {
+	if d < 1 {
+		return 1
+	}
+
+	if d > max {
+		return max
+	}
+
+	return d
+}
+
+// orientImage turns the image upright as per the exif orientation between 1 and 8
+func orientImage(src image.Image, o int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	switch o {
+	case 2:
+		// mirrored horizontally
+		return remapImage(src, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	case 3:
+		// rotated 180
+		return remapImage(src, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 4:
+		// mirrored vertically
+		return remapImage(src, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	case 5:
+		// mirrored along the main diagonal
+		return remapImage(src, h, w, func(x, y int) (int, int) { return y, x })
+	case 6:
+		// needs rotating 90 clockwise
+		return remapImage(src, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 7:
+		// mirrored along the anti diagonal
+		return remapImage(src, h, w, func(x, y int) (int, int) { return w - 1 - y, h - 1 - x })
+	case 8:
+		// needs rotating 90 counter clockwise
+		return remapImage(src, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	}
+
+	return src
+}
+
+// remapImage returns a w x h image with each pixel copied from the src pixel
+// returned by fn, both relative to the image origin
+func remapImage(src image.Image, w, h int, fn func(x, y int) (int, int)) *image.RGBA {
+	b := src.Bounds()
+	s, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		s = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(s, s.Bounds(), src, b.Min, draw.Src)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := fn(x, y)
+			si, di := s.PixOffset(sx, sy), dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], s.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+// rotateImage rotates the image clockwise by angle degrees in [0, 360)
+// right angles are exact, other angles grow the image to fit the rotated
+// corners and fill the uncovered area with bg, canvases larger than maxPixels are rejected
+func rotateImage(src image.Image, angle float64, bg color.Color) (image.Image, error) {
+	switch angle {
+	case 0:
+		return src, nil
+	case 90:
+		return orientImage(src, 6), nil
+	case 180:
+		return orientImage(src, 3), nil
+	case 270:
+		return orientImage(src, 8), nil
+	}
+
+	b := src.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	// the epsilon keeps the rounding errors from adding a pixel
+	dw := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin) - 1e-9))
+	dh := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos) - 1e-9))
+	if dw*dh > maxPixels {
+		return nil, fmt.Errorf("rotated image of %dx%d is larger than %d pixels", dw, dh, maxPixels)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	// rotate around the source center on to the destination center, y grows downwards
+	scx, scy := float64(b.Min.X)+w/2, float64(b.Min.Y)+h/2
+	dcx, dcy := float64(dw)/2, float64(dh)/2
+	s2d := f64.Aff3{
+		cos, -sin, dcx - cos*scx + sin*scy,
+		sin, cos, dcy - sin*scx - cos*scy,
+	}
+
+	xdraw.BiLinear.Transform(dst, s2d, src, b, xdraw.Src, nil)
+	return dst, nil
+}
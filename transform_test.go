@@ -0,0 +1,280 @@
+package progimg
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+
+	return img
+}
+
+func Test_resizeImage(t *testing.T) {
+	src := testImage(400, 200)
+	tests := []struct {
+		w, h   int
+		fit    string
+		ew, eh int
+	}{
+		{w: 100, fit: fitInside, ew: 100, eh: 50},
+		{h: 100, fit: fitCover, ew: 200, eh: 100},
+		{w: 100, h: 100, fit: fitInside, ew: 100, eh: 50},
+		{w: 100, h: 100, fit: fitContain, ew: 100, eh: 100},
+		{w: 100, h: 100, fit: fitCover, ew: 100, eh: 100},
+		{w: 100, h: 100, fit: fitFill, ew: 100, eh: 100},
+		{w: 800, h: 800, fit: fitInside, ew: 800, eh: 400},
+	}
+
+	for _, c := range tests {
+		dst := resizeImage(src, c.w, c.h, c.fit, "center", whiteBackground)
+		b := dst.Bounds()
+		if b.Dx() != c.ew || b.Dy() != c.eh {
+			t.Fatalf("%dx%d %s: expected %dx%d but got %dx%d",
+				c.w, c.h, c.fit, c.ew, c.eh, b.Dx(), b.Dy())
+		}
+	}
+
+	// contain pads the letterbox with background
+	dst := resizeImage(src, 100, 100, fitContain, "center", whiteBackground)
+	if r, g, b, _ := dst.At(50, 5).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Fatalf("expected white padding but got %v", dst.At(50, 5))
+	}
+
+	// cover keeps the center of the image
+	dst = resizeImage(src, 100, 100, fitCover, "center", whiteBackground)
+	if r, _, _, _ := dst.At(0, 50).RGBA(); r>>8 < 90 || r>>8 > 110 {
+		t.Fatalf("expected the center crop but got %v", dst.At(0, 50))
+	}
+}
+
+func Test_cropImage(t *testing.T) {
+	src := testImage(400, 200)
+	tests := []struct {
+		rect    image.Rectangle
+		size    image.Point
+		gravity string
+		er      image.Rectangle
+		err     string
+	}{
+		{
+			rect: image.Rect(10, 20, 110, 70),
+			er:   image.Rect(10, 20, 110, 70),
+		},
+
+		{
+			rect: image.Rect(350, 150, 500, 500),
+			er:   image.Rect(350, 150, 400, 200),
+		},
+
+		{
+			rect: image.Rect(500, 10, 600, 20),
+			err:  "crop is outside the image bounds",
+		},
+
+		{
+			size:    image.Pt(100, 100),
+			gravity: "center",
+			er:      image.Rect(150, 50, 250, 150),
+		},
+
+		{
+			size:    image.Pt(100, 100),
+			gravity: "northwest",
+			er:      image.Rect(0, 0, 100, 100),
+		},
+
+		{
+			size:    image.Pt(100, 100),
+			gravity: "southeast",
+			er:      image.Rect(300, 100, 400, 200),
+		},
+
+		{
+			size:    image.Pt(1000, 50),
+			gravity: "south",
+			er:      image.Rect(0, 150, 400, 200),
+		},
+	}
+
+	for _, c := range tests {
+		dst, err := cropImage(src, c.rect, c.size, c.gravity)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if dst.Bounds() != c.er {
+			t.Fatalf("expected %v but got %v", c.er, dst.Bounds())
+		}
+	}
+
+	// gravity decides the region kept by cover fit
+	dst := resizeImage(src, 100, 100, fitCover, "west", whiteBackground)
+	if r, _, _, _ := dst.At(0, 50).RGBA(); r>>8 > 10 {
+		t.Fatalf("expected the west crop but got %v", dst.At(0, 50))
+	}
+}
+
+func Test_encodeImage_options(t *testing.T) {
+	src := testPhoto(128, 96, false)
+	tests := []struct {
+		format       string
+		small, large encodeOptions
+	}{
+		{
+			format: "jpeg",
+			small:  encodeOptions{quality: 10},
+			large:  encodeOptions{quality: 95},
+		},
+
+		{
+			format: "png",
+			small:  encodeOptions{compression: "best"},
+			large:  encodeOptions{compression: "none"},
+		},
+	}
+
+	for _, c := range tests {
+		small, err := encodeImage(src, c.format, &c.small)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		large, err := encodeImage(src, c.format, &c.large)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(small) >= len(large) {
+			t.Fatalf("%s: expected %v to be smaller than %v: %d >= %d",
+				c.format, c.small, c.large, len(small), len(large))
+		}
+	}
+
+	// requested quality is bounded by the server settings
+	settings := encoder
+	encoder.minQuality, encoder.maxQuality = 30, 80
+	defer func() { encoder = settings }()
+	for q, e := range map[string]int{"10": 30, "50": 50, "100": 80} {
+		p, err := parseQueryPipeline(url.Values{"quality": {q}})
+		if err != nil || p.opts.quality != e {
+			t.Fatalf("expected quality %d but got %d: %v", e, p.opts.quality, err)
+		}
+	}
+}
+
+func Test_orientImage(t *testing.T) {
+	src := testImage(3, 2)
+	w, h := 3, 2
+	tests := []struct {
+		o            int
+		size         image.Point
+		first, right image.Point // first, right: source pixels of the top left and top right pixels
+	}{
+		{o: 1, size: image.Pt(w, h), first: image.Pt(0, 0), right: image.Pt(w-1, 0)},
+		{o: 2, size: image.Pt(w, h), first: image.Pt(w-1, 0), right: image.Pt(0, 0)},
+		{o: 3, size: image.Pt(w, h), first: image.Pt(w-1, h-1), right: image.Pt(0, h-1)},
+		{o: 4, size: image.Pt(w, h), first: image.Pt(0, h-1), right: image.Pt(w-1, h-1)},
+		{o: 5, size: image.Pt(h, w), first: image.Pt(0, 0), right: image.Pt(0, h-1)},
+		{o: 6, size: image.Pt(h, w), first: image.Pt(0, h-1), right: image.Pt(0, 0)},
+		{o: 7, size: image.Pt(h, w), first: image.Pt(w-1, h-1), right: image.Pt(w-1, 0)},
+		{o: 8, size: image.Pt(h, w), first: image.Pt(w-1, 0), right: image.Pt(w-1, h-1)},
+	}
+
+	for _, c := range tests {
+		dst := orientImage(src, c.o)
+		b := dst.Bounds()
+		if b.Size() != c.size {
+			t.Fatalf("%d: expected size %v but got %v", c.o, c.size, b.Size())
+		}
+
+		if !sameColor(dst.At(0, 0), src.At(c.first.X, c.first.Y)) ||
+			!sameColor(dst.At(b.Dx()-1, 0), src.At(c.right.X, c.right.Y)) {
+			t.Fatalf("%d: unexpected pixels %v %v", c.o, dst.At(0, 0), dst.At(b.Dx()-1, 0))
+		}
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
+
+// boundsImage is a uniform image with the given bounds which allocates no pixels
+type boundsImage struct {
+	*image.Uniform
+	r image.Rectangle
+}
+
+func (m boundsImage) Bounds() image.Rectangle { return m.r }
+
+func Test_rotateImage_large(t *testing.T) {
+	// a square at the size limit grows past it when rotated by other than right angles
+	src := boundsImage{image.NewUniform(color.Black), image.Rect(0, 0, maxDimension, maxDimension)}
+	for _, angle := range []float64{1, 45, 300} {
+		_, err := rotateImage(src, angle, color.White)
+		if err == nil {
+			t.Fatalf("%v: expected an error for the canvas larger than %d pixels", angle, maxPixels)
+		}
+	}
+}
+
+func Test_rotateImage(t *testing.T) {
+	src := testImage(100, 50)
+	bg := color.RGBA{0xff, 0, 0, 0xff}
+	tests := []struct {
+		angle float64
+		size  image.Point
+	}{
+		{angle: 0, size: image.Pt(100, 50)},
+		{angle: 90, size: image.Pt(50, 100)},
+		{angle: 180, size: image.Pt(100, 50)},
+		{angle: 270, size: image.Pt(50, 100)},
+		{angle: 45, size: image.Pt(107, 107)},
+		{angle: 30, size: image.Pt(112, 94)},
+	}
+
+	for _, c := range tests {
+		dst, err := rotateImage(src, c.angle, bg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v: %v", c.angle, err)
+		}
+
+		b := dst.Bounds()
+		if b.Size() != c.size {
+			t.Fatalf("%v: expected size %v but got %v", c.angle, c.size, b.Size())
+		}
+
+		if c.angle == 45 || c.angle == 30 {
+			// corners are filled with bg and the center stays in place
+			if !sameColor(dst.At(0, 0), bg) {
+				t.Fatalf("%v: expected bg corner but got %v", c.angle, dst.At(0, 0))
+			}
+
+			r, g, _, _ := dst.At(b.Dx()/2, b.Dy()/2).RGBA()
+			if absDiff(r>>8, 50) > 2 || absDiff(g>>8, 25) > 2 {
+				t.Fatalf("%v: unexpected center %v", c.angle, dst.At(b.Dx()/2, b.Dy()/2))
+			}
+		}
+	}
+
+	// 90 degrees clockwise moves the bottom left corner to the top left
+	dst, _ := rotateImage(src, 90, bg)
+	if !sameColor(dst.At(0, 0), src.At(0, 49)) {
+		t.Fatalf("unexpected rotation: %v != %v", dst.At(0, 0), src.At(0, 49))
+	}
+}
@@ -2,30 +2,43 @@ package progimg
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/fnv"
 	"image"
 	"image/color"
-	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"math/rand"
-	"os"
+	"net/http"
+	"strings"
 	"time"
-)
 
-// defaultPath to store the images
-const defaultPath = "./images"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+	"golang.org/x/sync/singleflight"
+)
 
-// whiteBackground while converting from png to jpeg
+// whiteBackground is the default background for the removed alpha
 var whiteBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
 
+// transformFlight coalesces the concurrent transformations of the same derivative
+var transformFlight singleflight.Group
+
 // supportedCTs holds all the supported content types
-var supportedCTs = []string{"png", "jpeg", "image/png", "image/jpeg"}
+var supportedCTs = []string{
+	"png", "jpeg", "gif", "webp", "bmp", "tiff",
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp", "image/tiff",
+}
+
+// tiffHeaders are the little and big endian magic bytes of tiff images
+// which are not sniffed by http.DetectContentType
+var tiffHeaders = [][]byte{[]byte("II*\x00"), []byte("MM\x00*")}
 
 func init() {
-	os.MkdirAll(defaultPath, 0766)
+	derivatives, _ = NewCache(defaultCacheSize, "")
 }
 
 // newID returns a new unique id
@@ -36,6 +49,22 @@ func newID() uint64 {
 	return h.Sum64()
 }
 
+// validID checks if the id is safe to be used as a file name
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// detectContentType returns the content type of the data
+func detectContentType(data []byte) string {
+	for _, h := range tiffHeaders {
+		if bytes.HasPrefix(data, h) {
+			return "image/tiff"
+		}
+	}
+
+	return http.DetectContentType(data)
+}
+
 // contentTypeOK checks if the given content-type present in the supported list
 func contentTypeOK(ct string) bool {
 	for _, t := range supportedCTs {
@@ -47,81 +76,214 @@ func contentTypeOK(ct string) bool {
 	return false
 }
 
-// getPath constructs the image path
-func getPath(id string) string {
-	return fmt.Sprintf("%s/%s", defaultPath, id)
+// saveImage will save the image uploaded through source to the image store and index it
+func saveImage(img *Image, source string) error {
+	err := imageStore.Put(img)
+	if err != nil {
+		return err
+	}
+
+	if derivatives != nil {
+		derivatives.Invalidate(img.ID)
+	}
+
+	if imageIndex == nil {
+		return nil
+	}
+
+	err = imageIndex.Put(newImageMeta(img, source))
+	if err != nil {
+		imageStore.Delete(img.ID)
+		return err
+	}
+
+	return nil
 }
 
-// saveImage will save the image at given path using gob encoding
-func saveImage(path string, img *Image) error {
-	f, err := os.Create(path)
+// orientQuality is the quality of the lossy originals encoded again after orienting
+const orientQuality = 95
+
+// orientOriginal turns the image upright as per its exif orientation
+// the image is encoded again in its format and webp mode which drops the exif data
+func orientOriginal(img *Image) error {
+	if exifOrientation(img) == 1 {
+		return nil
+	}
+
+	gimg, err := getGoImage(img)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	opts := &encodeOptions{quality: orientQuality, lossless: img.Format == "webp" && !lossyWebP(img)}
+	data, err := encodeImage(gimg, img.Format, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create file %s: %v", path, err)
+		return fmt.Errorf("failed to orient image: %v", err)
 	}
 
-	defer f.Sync()
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	return enc.Encode(img)
+	img.Data = data
+	return nil
+}
+
+// getImage will fetch the image with given id from the image store
+func getImage(id string) (*Image, error) {
+	return imageStore.Get(id)
 }
 
-// getImage will extract the image from the file using gob decoder
-func getImage(path string) (*Image, error) {
-	f, err := os.Open(path)
+// getDerivative fetches the image with given id transformed by the pipeline
+// derivatives are served from cache when possible and concurrent calls for
+// the same derivative share a single fetch and transformation
+// transformations run on the transform pool and fail with errQueueFull when it is busy
+func getDerivative(id string, p *pipeline) (*Image, error) {
+	if p.String() == "" {
+		return getImage(id)
+	}
+
+	key, err := p.cacheKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if derivatives != nil {
+		if img, ok := derivatives.Get(id, key); ok {
+			return img, nil
+		}
+	}
+
+	v, err, _ := transformFlight.Do(id+"/"+key, func() (interface{}, error) {
+		if derivatives != nil {
+			if img, ok := derivatives.Get(id, key); ok {
+				return img, nil
+			}
+		}
+
+		// reserved before the fetch so a delete from here on drops the derivative
+		var gen uint64
+		if derivatives != nil {
+			var release func()
+			gen, release = derivatives.Reserve(id)
+			defer release()
+		}
+
+		img, err := getImage(id)
+		if err != nil {
+			return nil, err
+		}
+
+		err = transformPool.do(func() error {
+			return transformImage(img, p)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if derivatives != nil {
+			derivatives.Put(id, key, gen, img)
+		}
+
+		return img, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file %s: %v", path, err)
+		return nil, err
 	}
 
-	defer f.Close()
-	dec := gob.NewDecoder(f)
-	var img Image
-	err = dec.Decode(&img)
-	return &img, err
+	return v.(*Image), nil
 }
 
-// getGoImage returns image.Image from our Image
-func getGoImage(img *Image) (image.Image, error) {
-	buf := bytes.NewReader(img.Data)
-	switch img.Format {
-	case "png":
-		return png.Decode(buf)
-	case "jpeg":
-		return jpeg.Decode(buf)
+// deleteImage removes the image with given id from the image store, derivative cache and index
+func deleteImage(id string) error {
+	err := imageStore.Delete(id)
+	if derivatives != nil {
+		cerr := derivatives.Invalidate(id)
+		if err == nil {
+			err = cerr
+		}
 	}
 
-	return nil, fmt.Errorf("unknown image format: %s", img.Format)
+	if imageIndex != nil {
+		ierr := imageIndex.Delete(id)
+		if err == nil && ierr != ErrImageNotFound {
+			err = ierr
+		}
+	}
+
+	return err
 }
 
-// transformImage will transform image to rct format
-func transformImage(rct string, img *Image) error {
-	if rct == img.Format {
-		return nil
+// colorModelName returns a readable name of the color model
+func colorModelName(m color.Model) string {
+	switch m {
+	case color.RGBAModel:
+		return "rgba"
+	case color.RGBA64Model:
+		return "rgba64"
+	case color.NRGBAModel:
+		return "nrgba"
+	case color.NRGBA64Model:
+		return "nrgba64"
+	case color.AlphaModel:
+		return "alpha"
+	case color.Alpha16Model:
+		return "alpha16"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.NYCbCrAModel:
+		return "nycbcra"
+	case color.CMYKModel:
+		return "cmyk"
 	}
 
-	gimg, err := getGoImage(img)
-	if err != nil {
-		return fmt.Errorf("failed to decode image: %v", err)
+	if _, ok := m.(color.Palette); ok {
+		return "paletted"
+	}
+
+	return "unknown"
+}
+
+// sha256Hex returns the hex encoded sha256 of data
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// getGoImage returns image.Image from our Image
+// gifs return their first frame and images with an exif orientation are turned upright
+// images larger than maxPixels are rejected before decoding, gifs check their frames as well
+func getGoImage(img *Image) (image.Image, error) {
+	if img.Format != "gif" {
+		c, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+		if err == nil && c.Width*c.Height > maxPixels {
+			return nil, fmt.Errorf("image of %dx%d is larger than %d pixels", c.Width, c.Height, maxPixels)
+		}
 	}
 
-	var buf bytes.Buffer
-	switch rct {
+	buf := bytes.NewReader(img.Data)
+	var gimg image.Image
+	var err error
+	switch img.Format {
 	case "png":
-		err = png.Encode(&buf, gimg)
+		gimg, err = png.Decode(buf)
 	case "jpeg":
-		dst := image.NewRGBA(gimg.Bounds())
-		draw.Draw(dst, dst.Bounds(), image.NewUniform(whiteBackground),
-			image.Point{}, draw.Src)
-		draw.Draw(dst, dst.Bounds(), gimg, gimg.Bounds().Min, draw.Over)
-		err = jpeg.Encode(&buf, dst, nil)
+		gimg, err = jpeg.Decode(buf)
+	case "gif":
+		gimg, err = decodeGIFFrame(img.Data, 1)
+	case "webp":
+		gimg, err = webp.Decode(buf)
+	case "bmp":
+		gimg, err = bmp.Decode(buf)
+	case "tiff":
+		gimg, err = tiff.Decode(buf)
 	default:
-		err = fmt.Errorf("unknown conversion format: %s", rct)
+		err = fmt.Errorf("unknown image format: %s", img.Format)
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to convert image: %v", err)
+		return nil, err
 	}
 
-	img.Format = rct
-	img.Data = buf.Bytes()
-	return nil
+	return orientImage(gimg, exifOrientation(img)), nil
 }
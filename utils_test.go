@@ -3,13 +3,36 @@ package progimg
 import (
 	"bytes"
 	"encoding/base64"
-	"fmt"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// TestMain runs the tests against a file store in a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "prog-image-store")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	imageStore, err = NewFileStore(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func Test_contentTypeOK(t *testing.T) {
 	tests := []struct {
 		ct string
@@ -21,7 +44,11 @@ func Test_contentTypeOK(t *testing.T) {
 		},
 		{
 			ct: "gif",
-			r:  false,
+			r:  true,
+		},
+		{
+			ct: "image/gif",
+			r:  true,
 		},
 		{
 			ct: "pdf",
@@ -41,6 +68,86 @@ func Test_contentTypeOK(t *testing.T) {
 	}
 }
 
+func Test_detectContentType(t *testing.T) {
+	tests := []struct {
+		file string
+		ct   string
+	}{
+		{
+			file: "./testdata/testimg.png",
+			ct:   "image/png",
+		},
+
+		{
+			file: "./testdata/testimg.webp",
+			ct:   "image/webp",
+		},
+
+		{
+			file: "./testdata/testpdf.pdf",
+			ct:   "application/pdf",
+		},
+	}
+
+	for _, c := range tests {
+		data, _ := base64.StdEncoding.DecodeString(getTestBase64(c.file))
+		if ct := detectContentType(data); ct != c.ct {
+			t.Fatalf("expected %s but got %s for %s", c.ct, ct, c.file)
+		}
+	}
+
+	for _, f := range []string{"bmp", "tiff"} {
+		data, err := encodeImage(testImage(20, 10), f, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: encode %s: %v", f, err)
+		}
+
+		ct := detectContentType(data)
+		if ct != "image/"+f || !contentTypeOK(ct) {
+			t.Fatalf("expected image/%s but got %s", f, ct)
+		}
+	}
+}
+
+func Test_getGoImage_formats(t *testing.T) {
+	webpData, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.webp"))
+	imgs := []*Image{newImage("webp", webpData)}
+	for _, f := range []string{"bmp", "tiff"} {
+		data, err := encodeImage(testImage(20, 10), f, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: encode %s: %v", f, err)
+		}
+
+		imgs = append(imgs, newImage(f, data))
+	}
+
+	for _, img := range imgs {
+		if img.Format == "webp" {
+			// webp is also encoded when transformed without a format
+			webpImg := *img
+			err := transformImage(&webpImg, &pipeline{ops: []operation{&resizeOp{width: 10, fit: fitInside}}})
+			if err != nil || webpImg.Format != "webp" {
+				t.Fatalf("unexpected error: resize webp: %v", err)
+			}
+		}
+
+		src, err := getGoImage(img)
+		if err != nil {
+			t.Fatalf("unexpected error: decode %s: %v", img.Format, err)
+		}
+
+		err = transformImage(img, &pipeline{format: "png"})
+		if err != nil {
+			t.Fatalf("unexpected error: transform %s: %v", img.Format, err)
+		}
+
+		gimg, err := getGoImage(img)
+		if err != nil || img.Format != "png" || gimg.Bounds() != src.Bounds() {
+			t.Fatalf("unexpected error: converted image: %s %v %v", img.Format, gimg, err)
+		}
+	}
+}
+
 func Test_saveImage_getImage(t *testing.T) {
 	tests := []*Image{
 		{
@@ -56,16 +163,13 @@ func Test_saveImage_getImage(t *testing.T) {
 		},
 	}
 
-	path := "./images"
-	os.Mkdir(path, 0766)
 	for _, i := range tests {
-		p := fmt.Sprintf("%s/%s", path, i.ID)
-		err := saveImage(p, i)
+		err := saveImage(i, "base64")
 		if err != nil {
 			t.Fatalf("unexpected error: save image: %v", err)
 		}
 
-		img, err := getImage(p)
+		img, err := getImage(i.ID)
 		if err != nil {
 			t.Fatalf("unexpected error: get image: %v", err)
 		}
@@ -116,7 +220,7 @@ func Test_transformImage(t *testing.T) {
 	for _, c := range tests {
 		data, _ := base64.StdEncoding.DecodeString(c.data)
 		img := newImage(c.ct, data)
-		err := transformImage(c.rct, img)
+		err := transformImage(img, &pipeline{format: c.rct})
 		if err != nil {
 			if strings.Contains(err.Error(), c.err) {
 				continue
@@ -135,3 +239,214 @@ func Test_transformImage(t *testing.T) {
 		}
 	}
 }
+
+func Test_colorModelName(t *testing.T) {
+	tests := []struct {
+		m    color.Model
+		name string
+	}{
+		{
+			m:    color.NRGBAModel,
+			name: "nrgba",
+		},
+
+		{
+			m:    color.YCbCrModel,
+			name: "ycbcr",
+		},
+
+		{
+			m:    color.Palette{color.Black, color.White},
+			name: "paletted",
+		},
+
+		{
+			m:    color.ModelFunc(func(c color.Color) color.Color { return c }),
+			name: "unknown",
+		},
+	}
+
+	for _, c := range tests {
+		name := colorModelName(c.m)
+		if name != c.name {
+			t.Fatalf("expected %s but got %s", c.name, name)
+		}
+	}
+}
+
+// slowStore counts and delays the image fetches of the wrapped store
+type slowStore struct {
+	ImageStore
+	mu   sync.Mutex
+	gets int
+}
+
+func (s *slowStore) Get(id string) (*Image, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	return s.ImageStore.Get(id)
+}
+
+func Test_getDerivative_coalesce(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.png"))
+	img := newImage("png", data)
+	err := saveImage(img, "base64")
+	if err != nil {
+		t.Fatalf("unexpected error: save image: %v", err)
+	}
+
+	store := &slowStore{ImageStore: imageStore}
+	imageStore = store
+	defer func() { imageStore = store.ImageStore }()
+
+	p, _ := parsePathPipeline("resize:64x/format:jpeg")
+	var wg sync.WaitGroup
+	imgs := make([]*Image, 10)
+	errs := make([]error, 10)
+	for i := range imgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			imgs[i], errs[i] = getDerivative(img.ID, p)
+		}(i)
+	}
+	wg.Wait()
+
+	if store.gets != 1 {
+		t.Fatalf("expected a single fetch but got %d", store.gets)
+	}
+
+	for i, dimg := range imgs {
+		if errs[i] != nil {
+			t.Fatalf("unexpected error: derivative: %v", errs[i])
+		}
+
+		if dimg.Format != "jpeg" || !bytes.Equal(dimg.Data, imgs[0].Data) {
+			t.Fatalf("unexpected error: derivative: %v", dimg)
+		}
+	}
+
+	// later calls are served from cache
+	_, err = getDerivative(img.ID, p)
+	if err != nil || store.gets != 1 {
+		t.Fatalf("expected cached derivative but got %d fetches, %v", store.gets, err)
+	}
+}
+
+// gatedStore fetches the image from the wrapped store and then waits for release
+type gatedStore struct {
+	ImageStore
+	fetched chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedStore) Get(id string) (*Image, error) {
+	img, err := s.ImageStore.Get(id)
+	close(s.fetched)
+	<-s.release
+	return img, err
+}
+
+func Test_getDerivative_delete(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.png"))
+	img := newImage("png", data)
+	err := saveImage(img, "base64")
+	if err != nil {
+		t.Fatalf("unexpected error: save image: %v", err)
+	}
+
+	store := &gatedStore{ImageStore: imageStore, fetched: make(chan struct{}), release: make(chan struct{})}
+	imageStore = store
+	defer func() { imageStore = store.ImageStore }()
+
+	p, _ := parsePathPipeline("resize:32x/format:jpeg")
+	done := make(chan error)
+	go func() {
+		_, err := getDerivative(img.ID, p)
+		done <- err
+	}()
+
+	// the image is deleted while its derivative is in flight
+	<-store.fetched
+	err = deleteImage(img.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: delete: %v", err)
+	}
+
+	close(store.release)
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error: derivative: %v", err)
+	}
+
+	if _, ok := derivatives.Get(img.ID, p.String()); ok {
+		t.Fatal("expected the derivative of the deleted image not to be cached")
+	}
+}
+
+func Test_getGoImage_budget(t *testing.T) {
+	// a png header claiming 16384x16384 without any image data
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, 16384)
+	binary.BigEndian.PutUint32(ihdr[4:], 16384)
+	ihdr[8], ihdr[9] = 8, 6
+	data := append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", ihdr)...)
+
+	_, err := getGoImage(newImage("png", data))
+	if err == nil || !strings.Contains(err.Error(), "image of 16384x16384 is larger than") {
+		t.Fatalf("expected the image to be rejected but got %v", err)
+	}
+}
+
+func Test_orientOriginal(t *testing.T) {
+	exif := testEXIF(binary.LittleEndian, 6)
+	jpg, err := encodeImage(testImage(40, 20), "jpeg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	lossless, err := encodeImage(testImage(40, 20), "webp", &encodeOptions{lossless: true})
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	lossy, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.webp"))
+	tests := []struct {
+		img  *Image
+		size image.Point
+	}{
+		{
+			img:  newImage("jpeg", withJPEGEXIF(jpg, exif)),
+			size: image.Pt(20, 40),
+		},
+
+		{
+			img:  newImage("webp", withWebPEXIF(t, lossless, exif)),
+			size: image.Pt(20, 40),
+		},
+
+		{
+			img:  newImage("webp", withWebPEXIF(t, lossy, exif)),
+			size: image.Pt(100, 150),
+		},
+	}
+
+	for _, c := range tests {
+		lossy := lossyWebP(c.img)
+		err := orientOriginal(c.img)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(c.img.Data))
+		if err != nil {
+			t.Fatalf("unexpected error: decode config: %v", err)
+		}
+
+		if image.Pt(cfg.Width, cfg.Height) != c.size || exifOrientation(c.img) != 1 || lossyWebP(c.img) != lossy {
+			t.Fatalf("unexpected %s image: %dx%d", c.img.Format, cfg.Width, cfg.Height)
+		}
+	}
+}
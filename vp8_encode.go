@@ -0,0 +1,955 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+)
+
+// vp8MaxDimension is the largest width or height of a vp8 frame
+const vp8MaxDimension = 1<<14 - 1
+
+// vp8 prediction modes of the 16x16 luma and 8x8 chroma blocks, section 12.2
+const (
+	vp8PredDC = iota
+	vp8PredTM
+	vp8PredVE
+	vp8PredHE
+)
+
+// vp8 limits on the frame partitions, section 9.5
+const (
+	vp8MaxFirstPartition = 1 << 19
+	vp8MaxPartition      = 1 << 24
+)
+
+// vp8MaxLevel is the largest quantized coefficient that can be coded
+const vp8MaxLevel = 2047
+
+// vp8Plane is a plane of 8 bit samples
+type vp8Plane struct {
+	pix    []uint8
+	stride int
+}
+
+// vp8Encoder encodes an image as a single vp8 key frame
+// only the 16x16 luma and 8x8 chroma predictions are used
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+	qi            int      // qi: quantizer index between 0 and 127
+	y1, y2, uv    [2]int32 // y1, y2, uv: dc and ac quantizer steps
+
+	src [3]vp8Plane // src: y, u and v planes padded to whole macroblocks
+	rec [3]vp8Plane // rec: reconstructed planes the decoder predicts from
+
+	ymodes  []uint8 // ymodes: luma prediction mode of each macroblock
+	uvmodes []uint8 // uvmodes: chroma prediction mode of each macroblock
+
+	// levels: quantized coefficients of each block in zigzag order, stored
+	// as the number of levels upto the last non zero one followed by the levels
+	levels []int16
+}
+
+// encodeVP8 encodes the image as a vp8 key frame of given quality between 1 and 100
+func encodeVP8(m *image.NRGBA, quality int) ([]byte, error) {
+	b := m.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > vp8MaxDimension || b.Dy() > vp8MaxDimension {
+		return nil, fmt.Errorf("image size %dx%d is out of vp8 limits", b.Dx(), b.Dy())
+	}
+
+	e := &vp8Encoder{
+		width:  b.Dx(),
+		height: b.Dy(),
+		mbw:    (b.Dx() + 15) / 16,
+		mbh:    (b.Dy() + 15) / 16,
+		qi:     vp8QualityToIndex(quality),
+	}
+
+	e.setupQuant()
+	e.setupPlanes(m)
+	e.ymodes = make([]uint8, e.mbw*e.mbh)
+	e.uvmodes = make([]uint8, e.mbw*e.mbh)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	return e.writeFrame()
+}
+
+// vp8QualityToIndex maps the quality to the quantizer index as libwebp does
+func vp8QualityToIndex(quality int) int {
+	c := float64(quality) / 100
+	if c < 0.75 {
+		c = c * 2 / 3
+	} else {
+		c = 2*c - 1
+	}
+
+	qi := int(math.Round(127 * (1 - math.Cbrt(c))))
+	if qi < 0 {
+		return 0
+	}
+
+	if qi > 127 {
+		return 127
+	}
+
+	return qi
+}
+
+// setupQuant sets the quantizer steps of the quantizer index, section 9.6
+func (e *vp8Encoder) setupQuant() {
+	dc, ac := int32(vp8DequantTableDC[e.qi]), int32(vp8DequantTableAC[e.qi])
+	e.y1 = [2]int32{dc, ac}
+	e.y2 = [2]int32{dc * 2, ac * 155 / 100}
+	if e.y2[1] < 8 {
+		e.y2[1] = 8
+	}
+
+	uvqi := e.qi
+	if uvqi > 117 {
+		uvqi = 117
+	}
+
+	e.uv = [2]int32{int32(vp8DequantTableDC[uvqi]), ac}
+}
+
+// setupPlanes converts the image to the limited range Y'CbCr 4:2:0 planes of vp8
+// the edge pixels are repeated to fill the last macroblocks
+func (e *vp8Encoder) setupPlanes(m *image.NRGBA) {
+	w, h := e.mbw*16, e.mbh*16
+	for i := range e.src {
+		pw, ph := w, h
+		if i > 0 {
+			pw, ph = w/2, h/2
+		}
+
+		e.src[i] = vp8Plane{pix: make([]uint8, pw*ph), stride: pw}
+		e.rec[i] = vp8Plane{pix: make([]uint8, pw*ph), stride: pw}
+	}
+
+	rgb := func(x, y int) (int32, int32, int32) {
+		if x >= e.width {
+			x = e.width - 1
+		}
+
+		if y >= e.height {
+			y = e.height - 1
+		}
+
+		i := m.PixOffset(m.Rect.Min.X+x, m.Rect.Min.Y+y)
+		return int32(m.Pix[i]), int32(m.Pix[i+1]), int32(m.Pix[i+2])
+	}
+
+	yp := e.src[0]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b := rgb(x, y)
+			yp.pix[y*yp.stride+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + 1<<15) >> 16)
+		}
+	}
+
+	up, vp := e.src[1], e.src[2]
+	for y := 0; y < h/2; y++ {
+		for x := 0; x < w/2; x++ {
+			var r, g, b int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := rgb(2*x+d[0], 2*y+d[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+
+			// r, g and b are the sums of 4 pixels so the result is shifted by 2 more bits
+			up.pix[y*up.stride+x] = vp8ClipUV(-9719*r - 19081*g + 28800*b)
+			vp.pix[y*vp.stride+x] = vp8ClipUV(28800*r - 24116*g - 4684*b)
+		}
+	}
+}
+
+// vp8ClipUV scales the chroma sum of 4 pixels to 8 bits
+func vp8ClipUV(v int32) uint8 {
+	v = (v + 128<<18 + 1<<17) >> 18
+	if v < 0 {
+		return 0
+	}
+
+	if v > 255 {
+		return 255
+	}
+
+	return uint8(v)
+}
+
+// predict fills pred with the n x n prediction of the block at x, y of the
+// reconstructed plane using the edges a decoder sees, section 12.2
+func (e *vp8Encoder) predict(p vp8Plane, x, y, n int, mode uint8, pred []int32) {
+	var top, left [16]int32
+	var corner int32
+	for i := 0; i < n; i++ {
+		top[i], left[i] = 127, 129
+		if y > 0 {
+			top[i] = int32(p.pix[(y-1)*p.stride+x+i])
+		}
+
+		if x > 0 {
+			left[i] = int32(p.pix[(y+i)*p.stride+x-1])
+		}
+	}
+
+	switch {
+	case y == 0:
+		corner = 127
+	case x == 0:
+		corner = 129
+	default:
+		corner = int32(p.pix[(y-1)*p.stride+x-1])
+	}
+
+	shift := uint(3)
+	if n == 16 {
+		shift = 4
+	}
+
+	for j := 0; j < n; j++ {
+		for i := 0; i < n; i++ {
+			var v int32
+			switch mode {
+			case vp8PredTM:
+				v = clip255(left[j] + top[i] - corner)
+			case vp8PredVE:
+				v = top[i]
+			case vp8PredHE:
+				v = left[j]
+			default:
+				v = 128
+				var sum int32
+				for k := 0; k < n; k++ {
+					sum += top[k] + left[k]
+				}
+
+				switch {
+				case x > 0 && y > 0:
+					v = (sum + int32(n)) >> (shift + 1)
+				case y > 0:
+					v = (sum - int32(n)*129 + int32(n/2)) >> shift
+				case x > 0:
+					v = (sum - int32(n)*127 + int32(n/2)) >> shift
+				}
+			}
+
+			pred[j*n+i] = v
+		}
+	}
+}
+
+// clip255 clips v to a sample value
+func clip255(v int32) int32 {
+	if v < 0 {
+		return 0
+	}
+
+	if v > 255 {
+		return 255
+	}
+
+	return v
+}
+
+// bestMode returns the prediction mode with least absolute error for the
+// n x n blocks at x, y of the planes, the predictions are left in preds
+func (e *vp8Encoder) bestMode(planes []int, x, y, n int, preds [][]int32) uint8 {
+	best, bestErr := uint8(vp8PredDC), int32(math.MaxInt32)
+	trial := make([][]int32, len(planes))
+	for i := range trial {
+		trial[i] = make([]int32, n*n)
+	}
+
+	for mode := uint8(vp8PredDC); mode <= vp8PredHE; mode++ {
+		var sad int32
+		for i, pl := range planes {
+			src := e.src[pl]
+			e.predict(e.rec[pl], x, y, n, mode, trial[i])
+			for j := 0; j < n; j++ {
+				for k := 0; k < n; k++ {
+					d := int32(src.pix[(y+j)*src.stride+x+k]) - trial[i][j*n+k]
+					if d < 0 {
+						d = -d
+					}
+
+					sad += d
+				}
+			}
+		}
+
+		if sad < bestErr {
+			best, bestErr = mode, sad
+			for i := range trial {
+				copy(preds[i], trial[i])
+			}
+		}
+	}
+
+	return best
+}
+
+// encodeMacroblock predicts, transforms and quantizes the macroblock and
+// reconstructs it the same way a decoder does
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	mb := mby*e.mbw + mbx
+	ypred := [][]int32{make([]int32, 256)}
+	e.ymodes[mb] = e.bestMode([]int{0}, mbx*16, mby*16, 16, ypred)
+
+	// luma dc coefficients are coded separately through the walsh hadamard transform
+	var coeffs [16][16]int32
+	var dc [16]int32
+	for b := 0; b < 16; b++ {
+		x, y := mbx*16+b%4*4, mby*16+b/4*4
+		vp8FDCT(e.src[0], x, y, ypred[0][b/4*64+b%4*4:], 16, &coeffs[b])
+		dc[b], coeffs[b][0] = coeffs[b][0], 0
+	}
+
+	var y2 [16]int32
+	vp8FWHT(&dc, &y2)
+	levels := e.quantize(&y2, e.y2, 0)
+	e.putLevels(&levels, 0)
+	e.dequantize(&levels, e.y2, &y2)
+	vp8IWHT(&y2, &dc)
+	for b := 0; b < 16; b++ {
+		levels = e.quantize(&coeffs[b], e.y1, 1)
+		e.putLevels(&levels, 1)
+		e.dequantize(&levels, e.y1, &coeffs[b])
+		coeffs[b][0] = dc[b]
+		x, y := mbx*16+b%4*4, mby*16+b/4*4
+		vp8IDCT(&coeffs[b], ypred[0][b/4*64+b%4*4:], 16, e.rec[0], x, y)
+	}
+
+	uvpred := [][]int32{make([]int32, 64), make([]int32, 64)}
+	e.uvmodes[mb] = e.bestMode([]int{1, 2}, mbx*8, mby*8, 8, uvpred)
+	for i, pl := range []int{1, 2} {
+		for b := 0; b < 4; b++ {
+			x, y := mbx*8+b%2*4, mby*8+b/2*4
+			pred := uvpred[i][b/2*32+b%2*4:]
+			var c [16]int32
+			vp8FDCT(e.src[pl], x, y, pred, 8, &c)
+			levels = e.quantize(&c, e.uv, 0)
+			e.putLevels(&levels, 0)
+			e.dequantize(&levels, e.uv, &c)
+			vp8IDCT(&c, pred, 8, e.rec[pl], x, y)
+		}
+	}
+}
+
+// quantize quantizes the coefficients from first with the dc and ac steps
+// rounding the ac coefficients towards zero a little more than the dc
+func (e *vp8Encoder) quantize(c *[16]int32, q [2]int32, first int) [16]int16 {
+	var levels [16]int16
+	for i := first; i < 16; i++ {
+		step, bias := q[1], q[1]*7/16
+		if i == 0 {
+			step, bias = q[0], q[0]/2
+		}
+
+		v := c[i]
+		if v < 0 {
+			v = -v
+		}
+
+		l := (v + bias) / step
+		if l > vp8MaxLevel {
+			l = vp8MaxLevel
+		}
+
+		if c[i] < 0 {
+			l = -l
+		}
+
+		levels[i] = int16(l)
+	}
+
+	return levels
+}
+
+// dequantize restores the coefficients from the levels as the decoder does
+func (e *vp8Encoder) dequantize(levels *[16]int16, q [2]int32, c *[16]int32) {
+	for i, l := range levels {
+		step := q[1]
+		if i == 0 {
+			step = q[0]
+		}
+
+		c[i] = int32(int16(int32(l) * step))
+	}
+}
+
+// putLevels stores the levels of the block in zigzag order
+func (e *vp8Encoder) putLevels(levels *[16]int16, first int) {
+	n := 0
+	for i := first; i < 16; i++ {
+		if levels[vp8Zigzag[i]] != 0 {
+			n = i + 1
+		}
+	}
+
+	e.levels = append(e.levels, int16(n))
+	for i := 0; i < n; i++ {
+		e.levels = append(e.levels, levels[vp8Zigzag[i]])
+	}
+}
+
+// vp8FDCT computes the forward dct of the 4x4 block at x, y of src minus pred
+// the transform is the integer approximation used by libwebp
+func vp8FDCT(src vp8Plane, x, y int, pred []int32, predStride int, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		s := src.pix[(y+i)*src.stride+x:]
+		p := pred[i*predStride:]
+		d0, d1 := int32(s[0])-p[0], int32(s[1])-p[1]
+		d2, d3 := int32(s[2])-p[2], int32(s[3])-p[3]
+		a0, a1, a2, a3 := d0+d3, d1+d2, d1-d2, d0-d3
+		tmp[0+i*4] = (a0 + a1) * 8
+		tmp[1+i*4] = (a2*2217 + a3*5352 + 1812) >> 9
+		tmp[2+i*4] = (a0 - a1) * 8
+		tmp[3+i*4] = (a3*2217 - a2*5352 + 937) >> 9
+	}
+
+	for i := 0; i < 4; i++ {
+		a0, a1 := tmp[0+i]+tmp[12+i], tmp[4+i]+tmp[8+i]
+		a2, a3 := tmp[4+i]-tmp[8+i], tmp[0+i]-tmp[12+i]
+		out[0+i] = (a0 + a1 + 7) >> 4
+		out[4+i] = (a2*2217 + a3*5352 + 12000) >> 16
+		if a3 != 0 {
+			out[4+i]++
+		}
+
+		out[8+i] = (a0 - a1 + 7) >> 4
+		out[12+i] = (a3*2217 - a2*5352 + 51000) >> 16
+	}
+}
+
+// vp8IDCT adds the inverse dct of the coefficients to pred and stores it at x, y of dst, section 14.3
+func vp8IDCT(c *[16]int32, pred []int32, predStride int, dst vp8Plane, x, y int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2).
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2).
+	)
+
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + cc
+		m[i][2] = b - cc
+		m[i][3] = a - d
+	}
+
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		p := pred[j*predStride:]
+		row := dst.pix[(y+j)*dst.stride+x:]
+		row[0] = uint8(clip255(p[0] + (a+d)>>3))
+		row[1] = uint8(clip255(p[1] + (b+cc)>>3))
+		row[2] = uint8(clip255(p[2] + (b-cc)>>3))
+		row[3] = uint8(clip255(p[3] + (a-d)>>3))
+	}
+}
+
+// vp8FWHT computes the forward walsh hadamard transform of the luma dc coefficients
+func vp8FWHT(in, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		a0, a1 := in[i*4+0]+in[i*4+2], in[i*4+1]+in[i*4+3]
+		a2, a3 := in[i*4+1]-in[i*4+3], in[i*4+0]-in[i*4+2]
+		tmp[0+i*4] = a0 + a1
+		tmp[1+i*4] = a3 + a2
+		tmp[2+i*4] = a3 - a2
+		tmp[3+i*4] = a0 - a1
+	}
+
+	for i := 0; i < 4; i++ {
+		a0, a1 := tmp[0+i]+tmp[8+i], tmp[4+i]+tmp[12+i]
+		a2, a3 := tmp[4+i]-tmp[12+i], tmp[0+i]-tmp[8+i]
+		out[0+i] = (a0 + a1) >> 1
+		out[4+i] = (a3 + a2) >> 1
+		out[8+i] = (a3 - a2) >> 1
+		out[12+i] = (a0 - a1) >> 1
+	}
+}
+
+// vp8IWHT computes the inverse walsh hadamard transform of the luma dc coefficients, section 14.3
+func vp8IWHT(in, out *[16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0, a1 := in[0+i]+in[12+i], in[4+i]+in[8+i]
+		a2, a3 := in[4+i]-in[8+i], in[0+i]-in[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0, a1 := dc+m[3+i*4], m[1+i*4]+m[2+i*4]
+		a2, a3 := m[1+i*4]-m[2+i*4], dc-m[3+i*4]
+		out[i*4+0] = int32(int16((a0 + a1) >> 3))
+		out[i*4+1] = int32(int16((a3 + a2) >> 3))
+		out[i*4+2] = int32(int16((a0 - a1) >> 3))
+		out[i*4+3] = int32(int16((a3 - a2) >> 3))
+	}
+}
+
+// vp8BoolEncoder is the boolean entropy encoder, section 7
+type vp8BoolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newVP8BoolEncoder() *vp8BoolEncoder {
+	return &vp8BoolEncoder{rng: 255, bitCount: 24}
+}
+
+// putBit encodes the bit where prob/256 is the probability of it being false
+func (e *vp8BoolEncoder) putBit(bit bool, prob uint8) {
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			// propagate the carry to the bytes already written
+			i := len(e.buf) - 1
+			for ; i >= 0 && e.buf[i] == 0xff; i-- {
+				e.buf[i] = 0
+			}
+
+			e.buf[i]++
+		}
+
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// putLiteral encodes the n bit unsigned value with even probability
+func (e *vp8BoolEncoder) putLiteral(v uint32, n uint) {
+	for n > 0 {
+		n--
+		e.putBit(v>>n&1 != 0, 128)
+	}
+}
+
+// flush pads the encoder so that the decoder can read all the bits and returns the data
+func (e *vp8BoolEncoder) flush() []byte {
+	for i := 0; i < 32; i++ {
+		e.putBit(false, 128)
+	}
+
+	return e.buf
+}
+
+// vp8TokenStats counts the false and true branches taken at each token probability
+type vp8TokenStats [vp8NPlane][vp8NBand][vp8NContext][vp8NProb][2]uint32
+
+// vp8TokenWriter writes the coefficient tokens of blocks, section 13
+// the branches are only counted when enc is nil
+type vp8TokenWriter struct {
+	enc   *vp8BoolEncoder
+	probs *vp8TokenProbs
+	stats *vp8TokenStats
+}
+
+func (t *vp8TokenWriter) put(bit bool, plane int, band uint8, ctx, i int) {
+	if t.stats != nil {
+		n := 0
+		if bit {
+			n = 1
+		}
+
+		t.stats[plane][band][ctx][i][n]++
+	}
+
+	if t.enc != nil {
+		t.enc.putBit(bit, t.probs[plane][band][ctx][i])
+	}
+}
+
+func (t *vp8TokenWriter) putFixed(bit bool, prob uint8) {
+	if t.enc != nil {
+		t.enc.putBit(bit, prob)
+	}
+}
+
+// writeBlock writes the levels of a block from first and returns whether any of them is non zero
+func (t *vp8TokenWriter) writeBlock(levels []int16, plane, ctx, first int) bool {
+	n := first
+	band := vp8Bands[n]
+	if len(levels) == 0 {
+		t.put(false, plane, band, ctx, 0)
+		return false
+	}
+
+	t.put(true, plane, band, ctx, 0)
+	for n < 16 {
+		v := levels[n]
+		n++
+		if v == 0 {
+			t.put(false, plane, band, ctx, 1)
+			band, ctx = vp8Bands[n], 0
+			continue
+		}
+
+		t.put(true, plane, band, ctx, 1)
+		a := int(v)
+		if a < 0 {
+			a = -a
+		}
+
+		t.writeLevel(a, plane, band, ctx)
+		band, ctx = vp8Bands[n], 2
+		if a == 1 {
+			ctx = 1
+		}
+
+		t.putFixed(v < 0, 128)
+		if n == 16 {
+			return true
+		}
+
+		more := n < len(levels)
+		t.put(more, plane, band, ctx, 0)
+		if !more {
+			return true
+		}
+	}
+
+	return true
+}
+
+// writeLevel writes the magnitude of a non zero level, section 13.2
+func (t *vp8TokenWriter) writeLevel(a, plane int, band uint8, ctx int) {
+	if a == 1 {
+		t.put(false, plane, band, ctx, 2)
+		return
+	}
+
+	t.put(true, plane, band, ctx, 2)
+	if a <= 4 {
+		t.put(false, plane, band, ctx, 3)
+		t.put(a != 2, plane, band, ctx, 4)
+		if a != 2 {
+			t.put(a == 4, plane, band, ctx, 5)
+		}
+
+		return
+	}
+
+	t.put(true, plane, band, ctx, 3)
+	if a <= 10 {
+		t.put(false, plane, band, ctx, 6)
+		t.put(a > 6, plane, band, ctx, 7)
+		if a <= 6 {
+			t.putFixed(a == 6, 159)
+		} else {
+			t.putFixed((a-7)&2 != 0, 165)
+			t.putFixed((a-7)&1 != 0, 145)
+		}
+
+		return
+	}
+
+	t.put(true, plane, band, ctx, 6)
+	cat := 3
+	switch {
+	case a < 19:
+		cat = 0
+	case a < 35:
+		cat = 1
+	case a < 67:
+		cat = 2
+	}
+
+	t.put(cat >= 2, plane, band, ctx, 8)
+	t.put(cat&1 != 0, plane, band, ctx, 9+cat>>1)
+	tab := vp8Cat3456[cat]
+	bits := 0
+	for tab[bits] != 0 {
+		bits++
+	}
+
+	v := a - (3 + 8<<uint(cat))
+	for i := 0; i < bits; i++ {
+		t.putFixed(v>>uint(bits-1-i)&1 != 0, tab[i])
+	}
+}
+
+// writeTokens writes the tokens of all the macroblocks tracking the non zero contexts
+// of the neighbouring blocks like the decoder, parts holds a writer for each partition
+// skip reports the macroblocks without any non zero level which are not written when
+// skipping is enabled
+func (e *vp8Encoder) writeTokens(parts []*vp8TokenWriter, useSkip bool, skip func(mb int)) {
+	type nzContext struct {
+		y2 int
+		y  [4]int
+		uv [4]int
+	}
+
+	up := make([]nzContext, e.mbw)
+	levels := e.levels
+	next := func() []int16 {
+		n := levels[0]
+		l := levels[1 : 1+n]
+		levels = levels[1+n:]
+		return l
+	}
+
+	for mby := 0; mby < e.mbh; mby++ {
+		t := parts[mby%len(parts)]
+		var left nzContext
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			// 1 y2, 16 y and 8 uv blocks
+			var blocks [25][]int16
+			empty := true
+			for i := range blocks {
+				blocks[i] = next()
+				empty = empty && len(blocks[i]) == 0
+			}
+
+			if empty && skip != nil {
+				skip(mby*e.mbw + mbx)
+			}
+
+			if empty && useSkip {
+				left, up[mbx] = nzContext{}, nzContext{}
+				continue
+			}
+
+			u := &up[mbx]
+			nz := t.writeBlock(blocks[0], vp8PlaneY2, left.y2+u.y2, 0)
+			left.y2, u.y2 = btoi(nz), btoi(nz)
+			for b := 0; b < 16; b++ {
+				x, y := b%4, b/4
+				nz = t.writeBlock(blocks[1+b], vp8PlaneY1WithY2, left.y[y]+u.y[x], 1)
+				left.y[y], u.y[x] = btoi(nz), btoi(nz)
+			}
+
+			// u blocks use the first two and v the last two contexts
+			for b := 0; b < 8; b++ {
+				c := b / 4 * 2
+				x, y := c+b%2, c+b%4/2
+				nz = t.writeBlock(blocks[17+b], vp8PlaneUV, left.uv[y]+u.uv[x], 0)
+				left.uv[y], u.uv[x] = btoi(nz), btoi(nz)
+			}
+		}
+	}
+}
+
+// btoi converts a bool to 0 or 1
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// vp8BitCost returns the bits needed to code count bits of value bit with prob
+func vp8BitCost(prob uint8, bit bool, count uint32) float64 {
+	p := float64(prob) / 256
+	if bit {
+		p = 1 - p
+	}
+
+	return -math.Log2(p) * float64(count)
+}
+
+// optimizeProbs returns the token probabilities fitting the counted branches
+// with the updates that save more bits than they cost
+func vp8OptimizeProbs(stats *vp8TokenStats) (probs vp8TokenProbs, update [vp8NPlane][vp8NBand][vp8NContext][vp8NProb]bool) {
+	probs = vp8DefaultTokenProb
+	for i := range stats {
+		for j := range stats[i] {
+			for k := range stats[i][j] {
+				for l, c := range stats[i][j][k] {
+					total := c[0] + c[1]
+					if total == 0 {
+						continue
+					}
+
+					p := (uint64(c[0])*256 + uint64(total)/2) / uint64(total)
+					if p < 1 {
+						p = 1
+					} else if p > 255 {
+						p = 255
+					}
+
+					old, upd := vp8DefaultTokenProb[i][j][k][l], vp8TokenProbUpdateProb[i][j][k][l]
+					saved := vp8BitCost(old, false, c[0]) + vp8BitCost(old, true, c[1]) -
+						vp8BitCost(uint8(p), false, c[0]) - vp8BitCost(uint8(p), true, c[1])
+					cost := vp8BitCost(upd, true, 1) + 8 - vp8BitCost(upd, false, 1)
+					if saved > cost {
+						probs[i][j][k][l] = uint8(p)
+						update[i][j][k][l] = true
+					}
+				}
+			}
+		}
+	}
+
+	return probs, update
+}
+
+// writeFrame writes the key frame header, the modes and the token partitions, section 9
+func (e *vp8Encoder) writeFrame() ([]byte, error) {
+	nmb := e.mbw * e.mbh
+	logParts := uint(0)
+	if nmb >= 1<<14 {
+		logParts = 3
+	}
+
+	// count the token branches and the skipped macroblocks to pick the probabilities
+	var stats vp8TokenStats
+	skipped := make([]bool, nmb)
+	nskip := 0
+	counter := &vp8TokenWriter{stats: &stats}
+	e.writeTokens([]*vp8TokenWriter{counter}, true, func(mb int) {
+		skipped[mb] = true
+		nskip++
+	})
+
+	probs, update := vp8OptimizeProbs(&stats)
+	fp := newVP8BoolEncoder()
+	fp.putLiteral(0, 2) // color space and clamping type
+	fp.putLiteral(0, 1) // segmentation
+	fp.putLiteral(0, 1) // normal loop filter
+	fp.putLiteral(uint32(vp8FilterLevel(e.qi)), 6)
+	fp.putLiteral(0, 3) // sharpness
+	fp.putLiteral(0, 1) // loop filter deltas
+	fp.putLiteral(uint32(logParts), 2)
+	fp.putLiteral(uint32(e.qi), 7)
+	fp.putLiteral(0, 5) // quantizer deltas
+	fp.putLiteral(0, 1) // refresh entropy probs
+	for i := range update {
+		for j := range update[i] {
+			for k := range update[i][j] {
+				for l, u := range update[i][j][k] {
+					fp.putBit(u, vp8TokenProbUpdateProb[i][j][k][l])
+					if u {
+						fp.putLiteral(uint32(probs[i][j][k][l]), 8)
+					}
+				}
+			}
+		}
+	}
+
+	useSkip := nskip > 0
+	skipProb := uint8(255 - (nskip*255+nmb/2)/nmb)
+	if skipProb < 1 {
+		skipProb = 1
+	}
+
+	fp.putLiteral(uint32(btoi(useSkip)), 1)
+	if useSkip {
+		fp.putLiteral(uint32(skipProb), 8)
+	}
+
+	for mb := 0; mb < nmb; mb++ {
+		if useSkip {
+			fp.putBit(skipped[mb], skipProb)
+		}
+
+		// 16x16 luma prediction
+		fp.putBit(true, 145)
+		switch e.ymodes[mb] {
+		case vp8PredDC:
+			fp.putBit(false, 156)
+			fp.putBit(false, 163)
+		case vp8PredVE:
+			fp.putBit(false, 156)
+			fp.putBit(true, 163)
+		case vp8PredHE:
+			fp.putBit(true, 156)
+			fp.putBit(false, 128)
+		case vp8PredTM:
+			fp.putBit(true, 156)
+			fp.putBit(true, 128)
+		}
+
+		fp.putBit(e.uvmodes[mb] != vp8PredDC, 142)
+		if e.uvmodes[mb] != vp8PredDC {
+			fp.putBit(e.uvmodes[mb] != vp8PredVE, 114)
+			if e.uvmodes[mb] != vp8PredVE {
+				fp.putBit(e.uvmodes[mb] == vp8PredTM, 183)
+			}
+		}
+	}
+
+	parts := make([]*vp8TokenWriter, 1<<logParts)
+	for i := range parts {
+		parts[i] = &vp8TokenWriter{enc: newVP8BoolEncoder(), probs: &probs}
+	}
+
+	e.writeTokens(parts, useSkip, nil)
+
+	first := fp.flush()
+	if len(first) >= vp8MaxFirstPartition {
+		return nil, fmt.Errorf("vp8 first partition is too large")
+	}
+
+	var buf bytes.Buffer
+	tag := uint32(1<<4 | len(first)<<5) // key frame, version 0, shown
+	buf.Write([]byte{byte(tag), byte(tag >> 8), byte(tag >> 16), 0x9d, 0x01, 0x2a})
+	binary.Write(&buf, binary.LittleEndian, [2]uint16{uint16(e.width), uint16(e.height)})
+	buf.Write(first)
+	var data [][]byte
+	for _, p := range parts {
+		d := p.enc.flush()
+		if len(d) >= vp8MaxPartition {
+			return nil, fmt.Errorf("vp8 partition is too large")
+		}
+
+		data = append(data, d)
+	}
+
+	for _, d := range data[:len(data)-1] {
+		buf.Write([]byte{byte(len(d)), byte(len(d) >> 8), byte(len(d) >> 16)})
+	}
+
+	for _, d := range data {
+		buf.Write(d)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// vp8FilterLevel returns the loop filter level for the quantizer index
+func vp8FilterLevel(qi int) int {
+	l := int(vp8DequantTableAC[qi]) / 6
+	if l > 63 {
+		return 63
+	}
+
+	return l
+}
@@ -0,0 +1,133 @@
+package progimg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// watermarkOp composites a stored image over the image
+type watermarkOp struct {
+	id       string      // id: ID of the stored watermark image
+	position string      // position: gravity of the watermark within the margins
+	margin   int         // margin: pixels kept clear between the watermark and the edges
+	opacity  int         // opacity: percent between 1 and 100
+	scale    int         // scale: width of the watermark as a percent of the image width, 0 keeps its size
+	mark     image.Image // mark: decoded watermark, loaded on first use
+}
+
+// parseWatermarkOp parses the watermark arguments, empty arguments take their defaults
+func parseWatermarkOp(id, position, margin, opacity, scale string) (*watermarkOp, error) {
+	if !validID(id) || strings.Contains(id, ":") {
+		return nil, fmt.Errorf("invalid watermark id: %s", id)
+	}
+
+	op := &watermarkOp{id: id, position: "southeast", opacity: 100}
+	if position != "" {
+		if _, ok := gravities[position]; !ok {
+			return nil, fmt.Errorf("unknown position: %s", position)
+		}
+
+		op.position = position
+	}
+
+	var err error
+	if margin != "" {
+		op.margin, err = strconv.Atoi(margin)
+		if err != nil || op.margin < 0 || op.margin > maxDimension {
+			return nil, fmt.Errorf("margin %s must be between 0 and %d", margin, maxDimension)
+		}
+	}
+
+	if opacity != "" {
+		op.opacity, err = parseDim(opacity, 100)
+		if err != nil {
+			return nil, fmt.Errorf("invalid opacity: %v", err)
+		}
+	}
+
+	if scale != "" {
+		op.scale, err = strconv.Atoi(scale)
+		if err != nil || op.scale < 0 || op.scale > 100 {
+			return nil, fmt.Errorf("scale %s must be between 0 and 100", scale)
+		}
+	}
+
+	return op, nil
+}
+
+// parseWatermarkPathOp parses watermark:id[:position[:margin[:opacity[:scale]]]]
+func parseWatermarkPathOp(args []string) (operation, error) {
+	if len(args) < 1 || len(args) > 5 {
+		return nil, fmt.Errorf("expected id[:position[:margin[:opacity[:scale]]]]")
+	}
+
+	a := make([]string, 5)
+	copy(a, args)
+	return parseWatermarkOp(a[0], a[1], a[2], a[3], a[4])
+}
+
+// load fetches and decodes the watermark once
+// animations reuse it for every frame
+func (op *watermarkOp) load() (image.Image, error) {
+	if op.mark != nil {
+		return op.mark, nil
+	}
+
+	img, err := getImage(op.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch watermark %s: %v", op.id, err)
+	}
+
+	op.mark, err = getGoImage(img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark %s: %v", op.id, err)
+	}
+
+	return op.mark, nil
+}
+
+func (op *watermarkOp) deps() []string {
+	return []string{op.id}
+}
+
+func (op *watermarkOp) apply(src image.Image, _ color.Color) (image.Image, error) {
+	mark, err := op.load()
+	if err != nil {
+		return nil, err
+	}
+
+	dst := toRGBA(src)
+	if op.scale > 0 {
+		w := scaleDim(dst.Rect.Dx(), float64(op.scale)/100)
+		mark = resizeImage(mark, w, 0, fitFill, "center", color.Transparent)
+	}
+
+	return watermarkImage(dst, mark, op.position, op.margin, op.opacity), nil
+}
+
+func (op *watermarkOp) String() string {
+	return fmt.Sprintf("watermark:%s:%s:%d:%d:%d", op.id, op.position, op.margin, op.opacity, op.scale)
+}
+
+// watermarkImage draws the mark over dst placed by position within the margins
+// the mark is clipped to dst when it doesn't fit
+func watermarkImage(dst *image.RGBA, mark image.Image, position string, margin, opacity int) *image.RGBA {
+	mb := mark.Bounds()
+	area := dst.Rect.Inset(margin)
+	if area.Empty() {
+		area = dst.Rect
+	}
+
+	var mask image.Image
+	if opacity < 100 {
+		mask = image.NewUniform(color.Alpha{uint8((opacity*0xff + 50) / 100)})
+	}
+
+	r := gravityRect(area, mb.Size(), position)
+	draw.DrawMask(dst, r, mark, mb.Min, mask, image.Point{}, draw.Over)
+	return dst
+}
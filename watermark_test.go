@@ -0,0 +1,178 @@
+package progimg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+func Test_watermarkOp(t *testing.T) {
+	// 10x10 red mark with a transparent left half
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 5; x < 10; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+		}
+	}
+
+	data, err := encodeImage(m, "png", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: encode: %v", err)
+	}
+
+	mark := newImage("png", data)
+	err = saveImage(mark, "base64")
+	if err != nil {
+		t.Fatalf("unexpected error: save image: %v", err)
+	}
+	defer deleteImage(mark.ID)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	tests := []struct {
+		args   []string
+		pixels map[image.Point]color.NRGBA
+		err    string
+	}{
+		{
+			args: []string{mark.ID},
+			pixels: map[image.Point]color.NRGBA{
+				{39, 19}: red,
+				{32, 15}: white,
+				{0, 0}:   white,
+			},
+		},
+
+		{
+			args: []string{mark.ID, "northwest", "5"},
+			pixels: map[image.Point]color.NRGBA{
+				{12, 7}: red,
+				{7, 7}:  white,
+				{2, 2}:  white,
+			},
+		},
+
+		{
+			args: []string{mark.ID, "center", "0", "50"},
+			pixels: map[image.Point]color.NRGBA{
+				{22, 10}: {0xff, 0x7f, 0x7f, 0xff},
+			},
+		},
+
+		{
+			args: []string{mark.ID, "southeast", "0", "100", "50"},
+			pixels: map[image.Point]color.NRGBA{
+				{35, 10}: red,
+				{25, 10}: white,
+			},
+		},
+
+		{
+			args: []string{"missing"},
+			err:  "failed to fetch watermark missing",
+		},
+	}
+
+	for _, c := range tests {
+		op, err := parseWatermarkPathOp(c.args)
+		if err != nil {
+			t.Fatalf("unexpected error: parse: %v", err)
+		}
+
+		dst, err := op.apply(src, nil)
+		if err != nil {
+			if c.err != "" && strings.Contains(err.Error(), c.err) {
+				continue
+			}
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if c.err != "" {
+			t.Fatalf("expected error: %s", c.err)
+		}
+
+		if dst.Bounds() != src.Bounds() {
+			t.Fatalf("%s: unexpected bounds %v", op, dst.Bounds())
+		}
+
+		for pt, want := range c.pixels {
+			got := color.NRGBAModel.Convert(dst.At(pt.X, pt.Y)).(color.NRGBA)
+			if got != want {
+				t.Fatalf("%s: expected %v at %v but got %v", op, want, pt, got)
+			}
+		}
+	}
+}
+
+func Test_getDerivative_watermark(t *testing.T) {
+	save := func(id string, c color.Color) *Image {
+		m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		data, err := encodeImage(m, "png", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: encode: %v", err)
+		}
+
+		img := newImage("png", data)
+		if id != "" {
+			img.ID = id
+		}
+
+		err = saveImage(img, "base64")
+		if err != nil {
+			t.Fatalf("unexpected error: save image: %v", err)
+		}
+
+		return img
+	}
+
+	base := save("", color.White)
+	defer deleteImage(base.ID)
+	mark := save("", color.NRGBA{0xff, 0, 0, 0xff})
+	path := "watermark:" + mark.ID + ":center/format:png"
+	for _, want := range []color.NRGBA{{0xff, 0, 0, 0xff}, {0, 0, 0xff, 0xff}} {
+		// the watermark is replaced by the second one under the same id
+		if want.B != 0 {
+			save(mark.ID, want)
+		}
+
+		// pipelines are parsed per request as the watermark op keeps its decoded mark
+		p, err := parsePathPipeline(path)
+		if err != nil {
+			t.Fatalf("unexpected error: parse: %v", err)
+		}
+
+		img, err := getDerivative(base.ID, p)
+		if err != nil {
+			t.Fatalf("unexpected error: derivative: %v", err)
+		}
+
+		gimg, err := getGoImage(img)
+		if err != nil {
+			t.Fatalf("unexpected error: decode: %v", err)
+		}
+
+		if got := color.NRGBAModel.Convert(gimg.At(5, 5)); got != want {
+			t.Fatalf("expected %v but got %v", want, got)
+		}
+	}
+
+	deleteImage(mark.ID)
+	p, err := parsePathPipeline(path)
+	if err != nil {
+		t.Fatalf("unexpected error: parse: %v", err)
+	}
+
+	_, err = getDerivative(base.ID, p)
+	if _, ok := err.(transformError); !ok {
+		t.Fatalf("expected transform error for the deleted watermark but got %v", err)
+	}
+}
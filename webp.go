@@ -0,0 +1,91 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// webpChunk is a chunk of the webp riff container
+type webpChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// encodeWebP encodes the image as lossy webp of given quality between 1 and 100
+// or as lossless webp, lossy images with transparency keep an uncompressed alpha plane
+func encodeWebP(w io.Writer, gimg image.Image, quality int, lossless bool) error {
+	if lossless {
+		return nativewebp.Encode(w, gimg, nil)
+	}
+
+	b := gimg.Bounds()
+	m := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), gimg, b.Min, draw.Src)
+	frame, err := encodeVP8(m, quality)
+	if err != nil {
+		return err
+	}
+
+	if m.Opaque() {
+		return writeWebP(w, webpChunk{"VP8 ", frame})
+	}
+
+	alpha := encodeWebPAlpha(m)
+
+	// VP8X with the alpha flag and the canvas size
+	vp8x := make([]byte, 10)
+	vp8x[0] = 1 << 4
+	putUint24(vp8x[4:], m.Rect.Dx()-1)
+	putUint24(vp8x[7:], m.Rect.Dy()-1)
+	return writeWebP(w, webpChunk{"VP8X", vp8x}, webpChunk{"ALPH", alpha}, webpChunk{"VP8 ", frame})
+}
+
+// encodeWebPAlpha returns the ALPH chunk of the image with the alpha plane stored uncompressed
+func encodeWebPAlpha(m *image.NRGBA) []byte {
+	// header byte 0 is no preprocessing, no filtering and no compression
+	alpha := make([]byte, 1+m.Rect.Dx()*m.Rect.Dy())
+	for i := 1; i < len(alpha); i++ {
+		alpha[i] = m.Pix[(i-1)*4+3]
+	}
+
+	return alpha
+}
+
+// lossyWebP checks if the image is a lossy webp
+func lossyWebP(img *Image) bool {
+	return img.Format == "webp" && webpChunkData(img.Data, "VP8 ") != nil
+}
+
+// writeWebP writes the chunks as a webp riff container
+func writeWebP(w io.Writer, chunks ...webpChunk) error {
+	size := 4
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(size))
+	buf.WriteString("WEBP")
+	for _, c := range chunks {
+		buf.WriteString(c.fourCC)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(c.data)))
+		buf.Write(c.data)
+		if len(c.data)&1 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// putUint24 writes v as a little endian 24 bit integer
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
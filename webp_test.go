@@ -0,0 +1,182 @@
+package progimg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testPhoto returns a w x h image with smooth gradients and sharp edges
+func testPhoto(w, h int, alpha bool) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: uint8(128 + 100*math.Sin(float64(x+y)/10)),
+				A: 0xff,
+			}
+
+			if (x/16+y/16)%2 == 0 && x > w/2 {
+				c.R, c.G, c.B = 20, 200, 40
+			}
+
+			if alpha {
+				c.A = uint8(x * 255 / w)
+			}
+
+			m.SetNRGBA(x, y, c)
+		}
+	}
+
+	return m
+}
+
+// psnr returns the peak signal to noise ratio between the planes
+func psnr(a, b []uint8) float64 {
+	var se float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		se += d * d
+	}
+
+	if se == 0 {
+		return math.Inf(1)
+	}
+
+	return 10 * math.Log10(255*255*float64(len(a))/se)
+}
+
+func Test_encodeWebP(t *testing.T) {
+	tests := []struct {
+		w, h     int
+		quality  int
+		alpha    bool
+		lossless bool
+		minPSNR  float64
+	}{
+		{w: 100, h: 60, quality: 75, minPSNR: 30},
+		{w: 33, h: 17, quality: 100, minPSNR: 40},
+		{w: 64, h: 64, quality: 1, minPSNR: 18},
+		{w: 50, h: 40, quality: 90, alpha: true, minPSNR: 33},
+		{w: 50, h: 40, alpha: true, lossless: true},
+	}
+
+	for _, c := range tests {
+		src := testPhoto(c.w, c.h, c.alpha)
+		var buf bytes.Buffer
+		err := encodeWebP(&buf, src, c.quality, c.lossless)
+		if err != nil {
+			t.Fatalf("unexpected error: encode: %v", err)
+		}
+
+		gimg, err := webp.Decode(&buf)
+		if err != nil {
+			t.Fatalf("unexpected error: decode %dx%d q%d: %v", c.w, c.h, c.quality, err)
+		}
+
+		if gimg.Bounds() != src.Bounds() {
+			t.Fatalf("expected bounds %v but got %v", src.Bounds(), gimg.Bounds())
+		}
+
+		if c.lossless {
+			for i := 0; i < c.w*c.h; i += 7 {
+				x, y := i%c.w, i/c.w
+				if got := color.NRGBAModel.Convert(gimg.At(x, y)); got != src.At(x, y) {
+					t.Fatalf("expected %v at %d,%d but got %v", src.At(x, y), x, y, got)
+				}
+			}
+
+			continue
+		}
+
+		// compare the luma planes as the decoder returns the frame without color conversion
+		e := &vp8Encoder{width: c.w, height: c.h, mbw: (c.w + 15) / 16, mbh: (c.h + 15) / 16}
+		e.setupPlanes(src)
+		var want, got []uint8
+		var alphaWant, alphaGot []uint8
+		for y := 0; y < c.h; y++ {
+			for x := 0; x < c.w; x++ {
+				want = append(want, e.src[0].pix[y*e.src[0].stride+x])
+				switch m := gimg.(type) {
+				case *image.YCbCr:
+					got = append(got, m.Y[m.YOffset(x, y)])
+				case *image.NYCbCrA:
+					got = append(got, m.Y[m.YOffset(x, y)])
+					alphaGot = append(alphaGot, m.A[m.AOffset(x, y)])
+					alphaWant = append(alphaWant, src.NRGBAAt(x, y).A)
+				default:
+					t.Fatalf("unexpected image type %T", gimg)
+				}
+			}
+		}
+
+		if p := psnr(want, got); p < c.minPSNR {
+			t.Fatalf("%dx%d q%d: expected psnr above %v but got %v", c.w, c.h, c.quality, c.minPSNR, p)
+		}
+
+		if c.alpha && !bytes.Equal(alphaWant, alphaGot) {
+			t.Fatalf("alpha mismatch")
+		}
+	}
+}
+
+func Test_encodeImage_webp(t *testing.T) {
+	jpg, _ := base64.StdEncoding.DecodeString(getTestBase64("./testdata/testimg.jpeg"))
+	src, err := getGoImage(newImage("jpeg", jpg))
+	if err != nil {
+		t.Fatalf("unexpected error: decode: %v", err)
+	}
+
+	tests := []struct {
+		opts    *encodeOptions
+		chunk   string
+		smaller bool // smaller: expected to be smaller than the jpeg
+	}{
+		{
+			opts:    nil,
+			chunk:   "VP8 ",
+			smaller: true,
+		},
+
+		{
+			opts:    &encodeOptions{quality: 50},
+			chunk:   "VP8 ",
+			smaller: true,
+		},
+
+		{
+			opts:  &encodeOptions{lossless: true},
+			chunk: "VP8L",
+		},
+	}
+
+	var sizes []int
+	for _, c := range tests {
+		data, err := encodeImage(src, "webp", c.opts)
+		if err != nil {
+			t.Fatalf("unexpected error: encode: %v", err)
+		}
+
+		if webpChunkData(data, c.chunk) == nil {
+			t.Fatalf("expected a %q chunk for %+v", c.chunk, c.opts)
+		}
+
+		if c.smaller && len(data) >= len(jpg) {
+			t.Fatalf("expected less than %d bytes but got %d for %+v", len(jpg), len(data), c.opts)
+		}
+
+		sizes = append(sizes, len(data))
+	}
+
+	// lower quality gives smaller images
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("expected quality 50 to be smaller than %d but got %d", sizes[0], sizes[1])
+	}
+}
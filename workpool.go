@@ -0,0 +1,90 @@
+package progimg
+
+import (
+	"errors"
+	"expvar"
+	"runtime"
+	"sync/atomic"
+)
+
+// defaultQueueSize is the number of transformations that can wait for a worker
+const defaultQueueSize = 64
+
+// retryAfter is the seconds clients are asked to wait when the queue is full
+const retryAfter = 1
+
+// errQueueFull is returned when the transformation can't be queued
+var errQueueFull = errors.New("server is busy, transform queue is full")
+
+// transformPool bounds the CPU heavy image decoding and encoding
+var transformPool = newWorkPool(runtime.NumCPU(), defaultQueueSize)
+
+// workPool limits the number of concurrently running jobs and the jobs waiting to run
+type workPool struct {
+	workers int
+	size    int
+	slots   chan struct{} // slots: held by the running jobs
+	admit   chan struct{} // admit: held by the running and waiting jobs
+
+	queued   int64
+	running  int64
+	rejected int64
+}
+
+// newWorkPool returns a pool running upto workers jobs with upto size jobs waiting
+func newWorkPool(workers, size int) *workPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	return &workPool{
+		workers: workers,
+		size:    size,
+		slots:   make(chan struct{}, workers),
+		admit:   make(chan struct{}, workers+size),
+	}
+}
+
+// do runs the job once a worker is free
+// errQueueFull is returned without running the job when the queue is full
+func (wp *workPool) do(job func() error) error {
+	select {
+	case wp.admit <- struct{}{}:
+	default:
+		atomic.AddInt64(&wp.rejected, 1)
+		return errQueueFull
+	}
+	defer func() { <-wp.admit }()
+
+	atomic.AddInt64(&wp.queued, 1)
+	wp.slots <- struct{}{}
+	atomic.AddInt64(&wp.queued, -1)
+	atomic.AddInt64(&wp.running, 1)
+	defer func() {
+		atomic.AddInt64(&wp.running, -1)
+		<-wp.slots
+	}()
+
+	return job()
+}
+
+// stats returns the current state of the pool
+func (wp *workPool) stats() map[string]int64 {
+	return map[string]int64{
+		"workers":    int64(wp.workers),
+		"queue_size": int64(wp.size),
+		"queued":     atomic.LoadInt64(&wp.queued),
+		"running":    atomic.LoadInt64(&wp.running),
+		"rejected":   atomic.LoadInt64(&wp.rejected),
+	}
+}
+
+func init() {
+	expvar.Publish("transform_pool", expvar.Func(func() interface{} {
+		return transformPool.stats()
+	}))
+}
@@ -0,0 +1,56 @@
+package progimg
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_workPool(t *testing.T) {
+	wp := newWorkPool(1, 1)
+	release := make(chan struct{})
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- wp.do(func() error {
+				<-release
+				return nil
+			})
+		}()
+	}
+
+	// wait for one job to run and the other to queue
+	for i := 0; ; i++ {
+		st := wp.stats()
+		if st["running"] == 1 && st["queued"] == 1 {
+			break
+		}
+
+		if i > 1000 {
+			t.Fatalf("unexpected pool stats: %v", st)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	err := wp.do(func() error { return nil })
+	if err != errQueueFull {
+		t.Fatalf("expected %v but got %v", errQueueFull, err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	st := wp.stats()
+	if st["running"] != 0 || st["queued"] != 0 || st["rejected"] != 1 {
+		t.Fatalf("unexpected pool stats: %v", st)
+	}
+
+	err = wp.do(func() error { return nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}